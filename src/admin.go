@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerAdminRoutes adds the /admin routes, which are only available if ADMIN_AUTH is set.
+func registerAdminRoutes(router *gin.Engine) {
+	if ADMIN_AUTH == "" {
+		logging.Info("Admin API is disabled, set ADMIN_AUTH to enable it")
+		return
+	}
+
+	admin := router.Group("/admin", requireAdmin)
+	admin.GET("/search", adminSearch)
+	admin.GET("/posts/:id/revisions", postHistory)
+	admin.GET("/posts/:id/refresh", refreshStatus)
+	admin.PUT("/posts/:id/pin", pinPost)
+	admin.DELETE("/posts/:id/pin", unpinPost)
+	admin.GET("/tombstones", vanishedPosts)
+	admin.GET("/jobs", jobStats)
+	admin.GET("/jobs/failed", failedJobs)
+	admin.POST("/jobs/retry", retryJobs)
+	admin.POST("/jobs/:id/retry", retryJobs)
+	admin.POST("/archive", startArchiveRun)
+	admin.GET("/archive", archiveRuns)
+	admin.GET("/archive/:id", archiveRun)
+	admin.GET("/metrics", gin.WrapH(expvar.Handler()))
+
+	logging.Info("Admin API is enabled")
+}
+
+// requireAdmin checks for "Authorization: Bearer <ADMIN_AUTH>"
+func requireAdmin(c *gin.Context) {
+	token, found := strings.CutPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(ADMIN_AUTH)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized", "ok": false})
+		return
+	}
+	c.Next()
+}
+
+// adminSearch searches the archive with the same parameters as /posts.json, without ever asking upstream.
+// Unlike /posts.json in offline mode, this always works.
+func adminSearch(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	serveOfflinePosts(ctx, c)
+}
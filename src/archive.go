@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// An archive run pages through a tag search upstream, and saves every post and its files like the proxy would.
+// Every page is a job, which queues the next one, so a run goes on where it stopped after a restart.
+
+const (
+	archiveRunning = "running"
+	archiveDone    = "done"
+
+	archivePageSize = 320 // the most e621 sends per page
+)
+
+var archiveDelay = 1 * time.Second // between two pages of a run, e621 asks for no more than 2 requests a second. Set with ARCHIVE_DELAY
+
+var (
+	errInvalidTarget  = errors.New("invalid archive target")
+	errArchiveOffline = errors.New("archiving needs upstream, OFFLINE_MODE is only")
+)
+
+// archivePage is the payload of a jobArchive.
+type archivePage struct {
+	RunID    int64 `json:"run_id"`
+	BeforeID int64 `json:"before_id"`
+}
+
+// archiveQuery returns the tag search for a target: a tag query, pool:<id>, set:<id> or fav:<user>, which all are tags upstream.
+// For pools, poolID is set, their metadata is saved too.
+func archiveQuery(target string) (tags string, poolID int64, err error) {
+	fields := strings.Fields(target)
+	if len(fields) == 0 {
+		return "", 0, fmt.Errorf("%w: it's empty", errInvalidTarget)
+	}
+
+	for _, tag := range fields {
+		// pages go by post id
+		if strings.HasPrefix(strings.TrimLeft(tag, "-~"), "order:") {
+			return "", 0, fmt.Errorf("%w: order: can't be archived", errInvalidTarget)
+		}
+	}
+
+	if len(fields) == 1 {
+		kind, value, _ := strings.Cut(fields[0], ":")
+		switch kind {
+		case "pool", "set":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id < 1 {
+				return "", 0, fmt.Errorf("%w: invalid %v ID %q", errInvalidTarget, kind, value)
+			}
+			if kind == "pool" {
+				poolID = id
+			}
+		case "fav":
+			if value == "" {
+				return "", 0, fmt.Errorf("%w: fav: needs a username", errInvalidTarget)
+			}
+		}
+	}
+	return strings.Join(fields, " "), poolID, nil
+}
+
+// startArchive starts archiving target, or goes on with the run that's already there.
+func startArchive(ctx context.Context, target string) (*ArchiveRun, error) {
+	if offlineMode == offlineOnly {
+		return nil, errArchiveOffline
+	}
+	target, _, err := archiveQuery(target)
+	if err != nil {
+		return nil, err
+	}
+
+	run, err := Database.StartArchiveRun(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	// if the page job died, this queues it again
+	if err := queueArchivePage(ctx, run, 0); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// queueArchivePage submits the next page of a run, after delay.
+func queueArchivePage(ctx context.Context, run *ArchiveRun, delay time.Duration) error {
+	job, err := newJob(jobArchive, fmt.Sprintf("archive:%d:%d", run.ID, run.BeforeID), jobPriorityArchive,
+		archivePage{RunID: run.ID, BeforeID: run.BeforeID})
+	if err != nil {
+		return err
+	}
+	job.RunAt = time.Now().Add(delay)
+	return submitJobs(ctx, []Job{job})
+}
+
+func runArchiveJob(ctx context.Context, payload json.RawMessage) error {
+	var page archivePage
+	if err := json.Unmarshal(payload, &page); err != nil {
+		return fmt.Errorf("%w: %v", errJobPermanent, err)
+	}
+
+	run, err := Database.GetArchiveRun(ctx, page.RunID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: archive run %d is gone", errJobPermanent, page.RunID)
+	}
+	if err != nil {
+		return err
+	}
+	// done already
+	if run.State != archiveRunning || run.BeforeID != page.BeforeID {
+		return nil
+	}
+
+	if err := archiveNextPage(ctx, run); err != nil {
+		run.LastError = err.Error()
+		if err := Database.UpdateArchiveRun(ctx, run); err != nil {
+			logging.Error("Error saving archive run %d: %v", run.ID, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// archiveNextPage saves the page of a run below run.BeforeID, and queues the one after it.
+func archiveNextPage(ctx context.Context, run *ArchiveRun) error {
+	tags, poolID, err := archiveQuery(run.Target)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errJobPermanent, err)
+	}
+	if poolID != 0 && run.Pages == 0 {
+		if err := archivePool(ctx, poolID); err != nil {
+			return err
+		}
+	}
+
+	query := url.Values{}
+	query.Set("tags", tags)
+	query.Set("limit", strconv.Itoa(archivePageSize))
+	if run.BeforeID > 0 {
+		query.Set("page", "b"+strconv.FormatInt(run.BeforeID, 10))
+	}
+	posts, err := fetchPosts(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	// an empty page is the end, fewer posts than asked for doesn't have to be
+	if len(posts) == 0 {
+		now := time.Now()
+		run.State = archiveDone
+		run.FinishedAt = &now
+		run.LastError = ""
+		logging.Info("Archived %v: %d posts on %d pages", run.Target, run.Posts, run.Pages)
+		return Database.UpdateArchiveRun(ctx, run)
+	}
+
+	if err := Database.UpsertPosts(ctx, posts); err != nil {
+		return err
+	}
+	var downloads []downloadJob
+	for _, post := range posts {
+		downloads = append(downloads, variantDownloads(post, variantOriginal, variantSample, variantPreview)...)
+		downloads = append(downloads, alternateDownloads(post)...)
+	}
+	if err := submitJobs(ctx, downloadJobs(downloads)); err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		if run.BeforeID == 0 || int64(post.ID) < run.BeforeID {
+			run.BeforeID = int64(post.ID)
+		}
+	}
+	run.Pages++
+	run.Posts += len(posts)
+	run.LastError = ""
+
+	// queued before the run is saved, if saving fails this page runs again and the next one skips itself
+	if err := queueArchivePage(ctx, run, archiveDelay); err != nil {
+		return err
+	}
+	logging.Debug("Archived page %d of %v, %d posts so far", run.Pages, run.Target, run.Posts)
+	return Database.UpdateArchiveRun(ctx, run)
+}
+
+// archivePool saves the metadata of a pool, which has the order of its posts.
+func archivePool(ctx context.Context, id int64) error {
+	var pool Pool
+	sourceURL, err := fetchUpstream(ctx, "/pools/"+strconv.FormatInt(id, 10)+".json", nil, &pool)
+	if err != nil {
+		return err
+	}
+	pool.setFetched(time.Now(), sourceURL)
+	return Database.UpdatePool(ctx, &pool)
+}
+
+// archiveCommand handles "e6-cache archive <tags>|pool:<id>|set:<id>|fav:<user>".
+// It runs the job workers until the run and its downloads are done. Interrupted runs go on when it's started again, or in the server.
+func archiveCommand(args []string) {
+	ctx := context.Background()
+	run, err := startArchive(ctx, strings.Join(args, " "))
+	if errors.Is(err, errInvalidTarget) {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Usage: e6-cache archive <tags>|pool:<id>|set:<id>|fav:<user>")
+		os.Exit(2)
+	}
+	if err != nil {
+		logging.Fatal("Failed to start archiving: %v", err)
+	}
+	fmt.Printf("Archiving %v (run %d, %d posts so far)\n", run.Target, run.ID, run.Posts)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	pages := run.Pages
+	for {
+		select {
+		case <-stop:
+			fmt.Println("Stopped, run the same command again to go on")
+			stopCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			jobs.stop(stopCtx)
+			return
+		case <-ticker.C:
+		}
+
+		run, err = Database.GetArchiveRun(ctx, run.ID)
+		if err != nil {
+			logging.Fatal("Failed to load archive run: %v", err)
+		}
+		counts, err := Database.JobCounts(ctx)
+		if err != nil {
+			logging.Fatal("Failed to count jobs: %v", err)
+		}
+		pending := map[string]int{}
+		for _, c := range counts {
+			if c.State != jobDead {
+				pending[c.Kind] += c.Count
+			}
+		}
+
+		if run.Pages != pages {
+			pages = run.Pages
+			fmt.Printf("Page %d: %d posts, %d downloads queued\n", run.Pages, run.Posts, pending[jobDownload])
+		}
+		if run.State == archiveDone && pending[jobDownload] == 0 {
+			fmt.Printf("Done: %d posts\n", run.Posts)
+			jobs.stop(ctx)
+			return
+		}
+		if run.State == archiveRunning && pending[jobArchive] == 0 {
+			fmt.Fprintf(os.Stderr, "Archiving stopped: %v\nSee /admin/jobs/failed, run the same command again to retry\n", run.LastError)
+			os.Exit(1)
+		}
+	}
+}
+
+// startArchiveRun starts archiving ?target=, or returns the run that's already going.
+func startArchiveRun(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	run, err := startArchive(ctx, c.Query("target"))
+	if errors.Is(err, errInvalidTarget) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "ok": false})
+		return
+	}
+	if errors.Is(err, errArchiveOffline) {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Not available in offline mode", "ok": false})
+		return
+	}
+	if err != nil {
+		logging.Error("Error starting archive run: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to start archiving", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, run)
+}
+
+// archiveRuns lists the latest runs and their progress.
+func archiveRuns(c *gin.Context) {
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, 1000)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	runs, err := Database.ArchiveRuns(ctx, limit)
+	if err != nil {
+		logging.Error("Error loading archive runs: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load archive runs", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// archiveRun shows the progress of one run.
+func archiveRun(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID", "ok": false})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	run, err := Database.GetArchiveRun(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Archive run not found", "ok": false})
+		return
+	}
+	if err != nil {
+		logging.Error("Error loading archive run %v: %v", id, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load archive run", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, run)
+}
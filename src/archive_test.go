@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestArchiveQuery(t *testing.T) {
+	for _, tt := range []struct {
+		target string
+		tags   string
+		poolID int64
+		valid  bool
+	}{
+		{"wolf  rating:s", "wolf rating:s", 0, true},
+		{"pool:123", "pool:123", 123, true},
+		{"set:45", "set:45", 0, true},
+		{"fav:someone", "fav:someone", 0, true},
+		{"pool:123 wolf", "pool:123 wolf", 0, true}, // just a tag search then
+		{"", "", 0, false},
+		{"   ", "", 0, false},
+		{"pool:abc", "", 0, false},
+		{"pool:0", "", 0, false},
+		{"pool:-1", "", 0, false},
+		{"set:", "", 0, false},
+		{"fav:", "", 0, false},
+		{"order:score", "", 0, false},
+		{"wolf -order:id", "", 0, false},
+		{"wolf ~order:random", "", 0, false},
+	} {
+		tags, poolID, err := archiveQuery(tt.target)
+		if !tt.valid {
+			if !errors.Is(err, errInvalidTarget) {
+				t.Errorf("archiveQuery(%q): expected an invalid target, got %q %v", tt.target, tags, err)
+			}
+			continue
+		}
+		if err != nil || tags != tt.tags || poolID != tt.poolID {
+			t.Errorf("archiveQuery(%q) = %q, %d, %v, want %q, %d", tt.target, tags, poolID, err, tt.tags, tt.poolID)
+		}
+	}
+}
+
+func TestStartArchiveOffline(t *testing.T) {
+	defer func(mode string) { offlineMode = mode }(offlineMode)
+	offlineMode = offlineOnly
+
+	_, err := startArchive(context.Background(), "wolf")
+	if !errors.Is(err, errArchiveOffline) || errors.Is(err, errInvalidTarget) {
+		t.Errorf("Expected errArchiveOffline, got %v", err)
+	}
+}
+
+// fakeArchiveUpstream answers /posts.json with 2 posts per page out of ids, going down from page=b<id>.
+func fakeArchiveUpstream(t *testing.T, ids ...int) (pages func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Query().Get("page"))
+		mu.Unlock()
+
+		before := 0
+		if page := r.URL.Query().Get("page"); page != "" {
+			before, _ = strconv.Atoi(strings.TrimPrefix(page, "b"))
+		}
+		var posts []string
+		for _, id := range ids {
+			if (before == 0 || id < before) && len(posts) < 2 {
+				posts = append(posts, fmt.Sprintf(`{"id": %d, "change_seq": 1}`, id))
+			}
+		}
+		fmt.Fprintf(w, `{"posts": [%s]}`, strings.Join(posts, ", "))
+	}))
+	t.Cleanup(server.Close)
+
+	oldBase, oldDelay := baseURL, archiveDelay
+	t.Cleanup(func() { baseURL, archiveDelay = oldBase, oldDelay })
+	baseURL, archiveDelay = server.URL, 0
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requested...)
+	}
+}
+
+// runArchivePage claims the next archive job and runs it.
+func runArchivePage(t *testing.T, d *sqlDB) archivePage {
+	t.Helper()
+	job := claim(t, d, time.Minute)
+	if job == nil || job.Kind != jobArchive {
+		t.Fatalf("Expected an archive job, got %+v", job)
+	}
+	var page archivePage
+	if err := json.Unmarshal(job.Payload, &page); err != nil {
+		t.Fatalf("Invalid archive page: %v", err)
+	}
+	if err := runArchiveJob(context.Background(), job.Payload); err != nil {
+		t.Fatalf("runArchiveJob failed: %v", err)
+	}
+	if err := d.FinishJob(context.Background(), job.ID); err != nil {
+		t.Fatalf("FinishJob failed: %v", err)
+	}
+	return page
+}
+
+func TestArchiveResume(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+	requested := fakeArchiveUpstream(t, 5, 4, 3, 2, 1)
+
+	run, err := startArchive(ctx, "wolf")
+	if err != nil {
+		t.Fatalf("startArchive failed: %v", err)
+	}
+	if page := runArchivePage(t, d); page.BeforeID != 0 {
+		t.Fatalf("Expected the first page, got before_id %d", page.BeforeID)
+	}
+
+	// started again, like after a restart, it goes on below the last page
+	again, err := startArchive(ctx, "wolf")
+	if err != nil {
+		t.Fatalf("startArchive failed: %v", err)
+	}
+	if again.ID != run.ID || again.BeforeID != 4 || again.Pages != 1 {
+		t.Fatalf("Expected run %d to go on before 4 after 1 page, got %+v", run.ID, again)
+	}
+
+	// a page that ran already does nothing
+	if err := runArchiveJob(ctx, json.RawMessage(fmt.Sprintf(`{"run_id": %d, "before_id": 0}`, run.ID))); err != nil {
+		t.Fatalf("runArchiveJob failed: %v", err)
+	}
+
+	for range 3 {
+		runArchivePage(t, d)
+	}
+	if job := claim(t, d, time.Minute); job != nil {
+		t.Errorf("Expected no more jobs, got %+v", job)
+	}
+
+	done, err := d.GetArchiveRun(ctx, run.ID)
+	if err != nil {
+		t.Fatalf("GetArchiveRun failed: %v", err)
+	}
+	if done.State != archiveDone || done.Posts != 5 || done.Pages != 3 || done.BeforeID != 1 {
+		t.Errorf("Expected the run done with 5 posts on 3 pages, got %+v", done)
+	}
+	if got, want := strings.Join(requested(), ","), ",b4,b2,b1"; got != want {
+		t.Errorf("Expected the pages %q, got %q", want, got)
+	}
+}
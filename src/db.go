@@ -2,9 +2,14 @@ package main
 
 import (
 	"bugmaschine/e6-cache/logging"
+	"bugmaschine/e6-cache/migrate"
+	"bugmaschine/e6-cache/tagquery"
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
@@ -12,8 +17,65 @@ import (
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
 
-type DB struct {
-	db *sql.DB
+// DB is where the metadata of the archive lives, PostgreSQL or SQLite.
+type DB interface {
+	Close() error
+	UpsertPost(ctx context.Context, p *Post) error
+	UpsertPosts(ctx context.Context, posts []*Post) error
+	GetPostRevisions(ctx context.Context, postID int64) ([]PostRevision, error)
+	SaveComments(comments []Comment) error
+	GetPost(ctx context.Context, id int64) (*Post, error)
+	GetPostByMD5(ctx context.Context, md5 string) (*Post, error)
+	DeletePost(ctx context.Context, id int64) error
+	UpdatePool(ctx context.Context, p *Pool) error
+	GetPool(ctx context.Context, id int64) (*Pool, error)
+	SearchPosts(ctx context.Context, q *tagquery.Query, limit, offset int) ([]*Post, error)
+	RawPayloads(ctx context.Context, table string, afterID int64, limit int) ([]RawPayload, error)
+	TombstonePost(ctx context.Context, id int64, reason string) (*Post, error)
+	Tombstones(ctx context.Context, since time.Time, includeRestored bool, limit int) ([]Tombstone, error)
+	StalePosts(ctx context.Context, before time.Time, pinnedOnly bool, limit int) ([]StalePost, error)
+	RecordRefresh(ctx context.Context, ids []int64, status, message string) error
+	PinPost(ctx context.Context, id int64, pinned bool) error
+	RefreshStatus(ctx context.Context, id int64) (*RefreshStatus, error)
+	EnqueueJobs(ctx context.Context, jobs []Job) (int, error)
+	ClaimJob(ctx context.Context, lease time.Duration) (*Job, error)
+	FinishJob(ctx context.Context, id int64) error
+	FailJob(ctx context.Context, job *Job, message string, retryAt *time.Time) error
+	JobCounts(ctx context.Context) ([]JobCount, error)
+	FailedJobs(ctx context.Context, limit int) ([]Job, error)
+	RetryJobs(ctx context.Context, id int64, kind string) (int64, error)
+	StartArchiveRun(ctx context.Context, target string) (*ArchiveRun, error)
+	GetArchiveRun(ctx context.Context, id int64) (*ArchiveRun, error)
+	ArchiveRuns(ctx context.Context, limit int) ([]ArchiveRun, error)
+	UpdateArchiveRun(ctx context.Context, run *ArchiveRun) error
+	Migrator() (*migrate.Migrator, error)
+}
+
+// sqlDialect has everything that differs between the databases. Both understand $1 params, so the queries are shared.
+type sqlDialect struct {
+	name       string // directory of its migrations
+	migrate    migrate.Dialect
+	array      func(v any) any                                      // wraps a slice (or a pointer to one, for Scan)
+	forUpdate  string                                               // row lock for SELECTs in transactions
+	skipLocked string                                               // like forUpdate, but skips rows other transactions hold
+	batchSize  int                                                  // posts per INSERT
+	search     func(q *tagquery.Query, firstParam int) tagquery.SQL // compiles a tag query
+}
+
+var postgresDialect = sqlDialect{
+	name:       "postgres",
+	migrate:    migrate.Postgres,
+	array:      func(v any) any { return pq.Array(v) },
+	forUpdate:  " FOR UPDATE",
+	skipLocked: " FOR UPDATE SKIP LOCKED",
+	batchSize:  200, // 51 params per post, PostgreSQL allows 65535 per statement
+	search:     (*tagquery.Query).Postgres,
+}
+
+// sqlDB implements DB for database/sql drivers.
+type sqlDB struct {
+	db      *sql.DB
+	dialect sqlDialect
 }
 
 func newDB(server, name, user, password string, port int) (DB, error) {
@@ -24,97 +86,370 @@ func newDB(server, name, user, password string, port int) (DB, error) {
 
 	dbConn, err := sql.Open("postgres", dbURI)
 	if err != nil {
-		return DB{}, err
+		return nil, err
 	}
 	if err = dbConn.Ping(); err != nil {
-		return DB{}, err
+		return nil, err
 	}
-	return DB{db: dbConn}, nil
+	return &sqlDB{db: dbConn, dialect: postgresDialect}, nil
 }
 
-func (d *DB) Close() error {
+func (d *sqlDB) Close() error {
 	return d.db.Close()
 }
 
-func (d *DB) CreatePost(ctx context.Context, p *Post) error {
+// postColumns are all columns of the posts table, in the order scanPost expects them.
+const postColumns = `
+	id, created_at, updated_at,
+	file_width, file_height, file_ext, file_size, file_md5, file_url,
+	preview_width, preview_height, preview_url,
+	sample_has, sample_width, sample_height, sample_url, sample_alternates,
+	score_up, score_down, score_total,
+	tags_general, tags_species, tags_character, tags_artist, tags_invalid, tags_lore, tags_meta,
+	locked_tags, change_seq,
+	flags_pending, flags_flagged, flags_note_locked, flags_status_locked, flags_rating_locked, flags_deleted,
+	rating, fav_count, sources, pools,
+	parent_id, has_children, has_active_children, children,
+	approver_id, uploader_id, description, comment_count, is_favorited
+`
+
+// archiveColumns are the columns with the upstream JSON, in posts, pools and comments. See archiveValues.
+const archiveColumns = `raw, fetched_at, source_url`
 
-	if p.UpdatedAt.IsZero() {
-		p.UpdatedAt = p.CreatedAt
+// archiveValues returns the values for archiveColumns. Entities we didn't decode from upstream have none.
+func archiveValues(a Archived) []any {
+	var raw, fetchedAt, sourceURL any
+	if len(a.Raw) > 0 {
+		raw = string(a.Raw) // pq would send []byte as bytea
+	}
+	if !a.FetchedAt.IsZero() {
+		fetchedAt = a.FetchedAt
+	}
+	if a.SourceURL != "" {
+		sourceURL = a.SourceURL
 	}
+	return []any{raw, fetchedAt, sourceURL}
+}
 
-	query := `
-	INSERT INTO posts (
-		id, created_at, updated_at,
-		file_width, file_height, file_ext, file_size, file_md5, file_url,
-		preview_width, preview_height, preview_url,
-		sample_has, sample_width, sample_height, sample_url,
-		score_up, score_down, score_total,
-		tags_general, tags_species, tags_character, tags_artist, tags_invalid, tags_lore, tags_meta,
-		locked_tags, change_seq,
-		flags_pending, flags_flagged, flags_note_locked, flags_status_locked, flags_rating_locked, flags_deleted,
-		rating, fav_count, sources, pools,
-		parent_id, has_children, has_active_children, children,
-		approver_id, uploader_id, description, comment_count, is_favorited
-	) VALUES (
-		$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19,
-		$20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35,
-		$36, $37, $38, $39, $40, $41, $42, $43, $44, $45, $46, $47
+// jsonValue stores v as JSON, in JSONB columns (TEXT in SQLite). Like jsonArray, it takes a pointer to v for scanning.
+type jsonValue struct {
+	v any
+}
+
+func (j jsonValue) Value() (driver.Value, error) {
+	data, err := json.Marshal(j.v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (j jsonValue) Scan(src any) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), j.v)
+	case []byte:
+		return json.Unmarshal(src, j.v)
+	case nil:
+		return nil
+	default:
+		return fmt.Errorf("can't scan %T as json", src)
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPost reads a row selected with postColumns.
+func (d *sqlDB) scanPost(row rowScanner) (*Post, error) {
+	p := &Post{}
+	err := row.Scan(
+		&p.ID, &p.CreatedAt, &p.UpdatedAt,
+		&p.File.Width, &p.File.Height, &p.File.Ext, &p.File.Size, &p.File.MD5, &p.File.URL,
+		&p.Preview.Width, &p.Preview.Height, &p.Preview.URL,
+		&p.Sample.Has, &p.Sample.Width, &p.Sample.Height, &p.Sample.URL, jsonValue{&p.Sample.Alternates},
+		&p.Score.Up, &p.Score.Down, &p.Score.Total,
+		d.dialect.array(&p.Tags.General), d.dialect.array(&p.Tags.Species), d.dialect.array(&p.Tags.Character),
+		d.dialect.array(&p.Tags.Artist), d.dialect.array(&p.Tags.Invalid), d.dialect.array(&p.Tags.Lore), d.dialect.array(&p.Tags.Meta),
+		d.dialect.array(&p.LockedTags), &p.ChangeSeq,
+		&p.Flags.Pending, &p.Flags.Flagged, &p.Flags.NoteLocked, &p.Flags.StatusLocked, &p.Flags.RatingLocked, &p.Flags.Deleted,
+		&p.Rating, &p.FavCount, d.dialect.array(&p.Sources), d.dialect.array(&p.Pools),
+		&p.Relationships.ParentID, &p.Relationships.HasChildren, &p.Relationships.HasActiveChildren, d.dialect.array(&p.Relationships.Children),
+		&p.ApproverID, &p.UploaderID, &p.Description, &p.CommentCount, &p.IsFavorited,
 	)
-	`
-	_, err := d.db.ExecContext(
-		ctx,
-		query,
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// postUpsert is the ON CONFLICT part of inserting posts. Scores and favorites don't bump change_seq upstream,
+// so an equal change_seq still gets written, but older versions never overwrite newer ones.
+// Urls upstream hides (null) keep their last known value, makeProxyLink decides who gets links to them.
+const postUpsert = `
+	ON CONFLICT (id) DO UPDATE SET
+		created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at,
+		file_width = EXCLUDED.file_width, file_height = EXCLUDED.file_height, file_ext = EXCLUDED.file_ext,
+		file_size = EXCLUDED.file_size, file_md5 = EXCLUDED.file_md5, file_url = COALESCE(NULLIF(EXCLUDED.file_url, ''), posts.file_url),
+		preview_width = EXCLUDED.preview_width, preview_height = EXCLUDED.preview_height, preview_url = COALESCE(NULLIF(EXCLUDED.preview_url, ''), posts.preview_url),
+		sample_has = EXCLUDED.sample_has, sample_width = EXCLUDED.sample_width, sample_height = EXCLUDED.sample_height, sample_url = COALESCE(NULLIF(EXCLUDED.sample_url, ''), posts.sample_url),
+		sample_alternates = EXCLUDED.sample_alternates,
+		score_up = EXCLUDED.score_up, score_down = EXCLUDED.score_down, score_total = EXCLUDED.score_total,
+		tags_general = EXCLUDED.tags_general, tags_species = EXCLUDED.tags_species, tags_character = EXCLUDED.tags_character,
+		tags_artist = EXCLUDED.tags_artist, tags_invalid = EXCLUDED.tags_invalid, tags_lore = EXCLUDED.tags_lore, tags_meta = EXCLUDED.tags_meta,
+		locked_tags = EXCLUDED.locked_tags, change_seq = EXCLUDED.change_seq,
+		flags_pending = EXCLUDED.flags_pending, flags_flagged = EXCLUDED.flags_flagged, flags_note_locked = EXCLUDED.flags_note_locked,
+		flags_status_locked = EXCLUDED.flags_status_locked, flags_rating_locked = EXCLUDED.flags_rating_locked, flags_deleted = EXCLUDED.flags_deleted,
+		rating = EXCLUDED.rating, fav_count = EXCLUDED.fav_count, sources = EXCLUDED.sources, pools = EXCLUDED.pools,
+		parent_id = EXCLUDED.parent_id, has_children = EXCLUDED.has_children, has_active_children = EXCLUDED.has_active_children, children = EXCLUDED.children,
+		approver_id = EXCLUDED.approver_id, uploader_id = EXCLUDED.uploader_id, description = EXCLUDED.description,
+		comment_count = EXCLUDED.comment_count, is_favorited = EXCLUDED.is_favorited,
+		raw = COALESCE(EXCLUDED.raw, posts.raw), fetched_at = COALESCE(EXCLUDED.fetched_at, posts.fetched_at),
+		source_url = COALESCE(EXCLUDED.source_url, posts.source_url)
+	WHERE posts.change_seq <= EXCLUDED.change_seq
+`
+
+// postValues returns the values of a post, in the order of postColumns.
+func (d *sqlDB) postValues(p *Post) []any {
+	alternates := p.Sample.Alternates
+	if alternates == nil {
+		alternates = Alternates{}
+	}
+
+	return []any{
 		p.ID, p.CreatedAt, p.UpdatedAt,
 		p.File.Width, p.File.Height, p.File.Ext, p.File.Size, p.File.MD5, p.File.URL,
 		p.Preview.Width, p.Preview.Height, p.Preview.URL,
-		p.Sample.Has, p.Sample.Width, p.Sample.Height, p.Sample.URL,
+		p.Sample.Has, p.Sample.Width, p.Sample.Height, p.Sample.URL, jsonValue{alternates},
 		p.Score.Up, p.Score.Down, p.Score.Total,
-		pq.Array(p.Tags.General), pq.Array(p.Tags.Species), pq.Array(p.Tags.Character),
-		pq.Array(p.Tags.Artist), pq.Array(p.Tags.Invalid), pq.Array(p.Tags.Lore), pq.Array(p.Tags.Meta),
-		pq.Array(p.LockedTags), p.ChangeSeq,
+		d.dialect.array(p.Tags.General), d.dialect.array(p.Tags.Species), d.dialect.array(p.Tags.Character),
+		d.dialect.array(p.Tags.Artist), d.dialect.array(p.Tags.Invalid), d.dialect.array(p.Tags.Lore), d.dialect.array(p.Tags.Meta),
+		d.dialect.array(p.LockedTags), p.ChangeSeq,
 		p.Flags.Pending, p.Flags.Flagged, p.Flags.NoteLocked, p.Flags.StatusLocked, p.Flags.RatingLocked, p.Flags.Deleted,
-		p.Rating, p.FavCount, pq.Array(p.Sources), pq.Array(p.Pools),
-		p.Relationships.ParentID, p.Relationships.HasChildren, p.Relationships.HasActiveChildren, pq.Array(p.Relationships.Children),
+		p.Rating, p.FavCount, d.dialect.array(p.Sources), d.dialect.array(p.Pools),
+		p.Relationships.ParentID, p.Relationships.HasChildren, p.Relationships.HasActiveChildren, d.dialect.array(p.Relationships.Children),
 		p.ApproverID, p.UploaderID, p.Description, p.CommentCount, p.IsFavorited,
-	)
+	}
+}
+
+// UpsertPost inserts a post, or updates the stored one if the incoming post isn't older than it.
+func (d *sqlDB) UpsertPost(ctx context.Context, p *Post) error {
+	return d.UpsertPosts(ctx, []*Post{p})
+}
+
+// UpsertPosts inserts or updates a whole page of posts in one transaction, see postUpsert.
+// If change_seq moved forward, the difference to the stored post is saved in post_revisions.
+func (d *sqlDB) UpsertPosts(ctx context.Context, posts []*Post) error {
+	posts = newestVersions(posts)
+	if len(posts) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(posts); start += d.dialect.batchSize {
+		chunk := posts[start:min(start+d.dialect.batchSize, len(posts))]
+		if err := d.upsertChunk(ctx, tx, chunk); err != nil {
+			logging.Error("Error upserting posts: %v", err)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *sqlDB) upsertChunk(ctx context.Context, tx *sql.Tx, posts []*Post) error {
+	ids := make([]any, len(posts))
+	params := make([]string, len(posts))
+	for i, p := range posts {
+		ids[i] = p.ID
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
 
+	rows, err := tx.QueryContext(ctx, `SELECT `+postColumns+` FROM posts WHERE id IN (`+strings.Join(params, ", ")+`)`+d.dialect.forUpdate, ids...)
 	if err != nil {
-		logging.Error("Error inserting post: %v", err)
+		return fmt.Errorf("loading stored posts: %w", err)
+	}
+	stored := map[int]*Post{}
+	for rows.Next() {
+		old, err := d.scanPost(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("loading stored posts: %w", err)
+		}
+		stored[old.ID] = old
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("loading stored posts: %w", err)
+	}
+
+	values := make([]string, len(posts))
+	args := make([]any, 0, len(posts)*51)
+	var present []any // posts that are fine upstream, their tombstones get restored
+	for i, p := range posts {
+		if p.UpdatedAt.IsZero() {
+			p.UpdatedAt = p.CreatedAt
+		}
+
+		old, ok := stored[p.ID]
+		if ok && old.ChangeSeq < p.ChangeSeq {
+			if err := insertRevision(ctx, tx, old, p); err != nil {
+				return fmt.Errorf("saving revision of post %d: %w", p.ID, err)
+			}
+		}
+
+		// older versions don't get written, so they don't say anything about the post either
+		if !ok || old.ChangeSeq <= p.ChangeSeq {
+			reason, known := vanishReason(p)
+			switch {
+			case reason == "":
+				present = append(present, p.ID)
+			case known:
+				state := p.Raw
+				if ok {
+					state, _ = json.Marshal(old)
+				}
+				if err := recordTombstone(ctx, tx, int64(p.ID), reason, state); err != nil {
+					return fmt.Errorf("saving tombstone of post %d: %w", p.ID, err)
+				}
+			}
+		}
+
+		postArgs := append(d.postValues(p), archiveValues(p.Archived)...)
+		placeholders := make([]string, len(postArgs))
+		for j := range postArgs {
+			placeholders[j] = fmt.Sprintf("$%d", len(args)+j+1)
+		}
+		values[i] = "(" + strings.Join(placeholders, ", ") + ")"
+		args = append(args, postArgs...)
+	}
+
+	if len(present) > 0 {
+		params := make([]string, len(present))
+		for i := range present {
+			params[i] = fmt.Sprintf("$%d", i+2)
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE post_tombstones SET restored_at = $1 WHERE restored_at IS NULL AND post_id IN (`+strings.Join(params, ", ")+`)`,
+			append([]any{time.Now()}, present...)...)
+		if err != nil {
+			return fmt.Errorf("restoring tombstones: %w", err)
+		}
+	}
+
+	query := `INSERT INTO posts (` + postColumns + `, ` + archiveColumns + `) VALUES ` + strings.Join(values, ", ") + postUpsert
+	_, err = tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// recordTombstone saves that a post vanished. If it already has a tombstone, that only gets updated,
+// unless the post was back in between, then it starts over with the new state.
+func recordTombstone(ctx context.Context, tx *sql.Tx, postID int64, reason string, state json.RawMessage) error {
+	var lastState any
+	if len(state) > 0 {
+		lastState = string(state)
 	}
+
+	now := time.Now()
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO post_tombstones (post_id, reason, first_seen_at, last_seen_at, last_state)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (post_id) DO UPDATE SET
+			reason = EXCLUDED.reason,
+			last_seen_at = EXCLUDED.last_seen_at,
+			first_seen_at = CASE WHEN post_tombstones.restored_at IS NULL THEN post_tombstones.first_seen_at ELSE EXCLUDED.first_seen_at END,
+			last_state = CASE WHEN post_tombstones.restored_at IS NULL THEN post_tombstones.last_state ELSE EXCLUDED.last_state END,
+			restored_at = NULL
+	`, postID, reason, now, now, lastState)
 	return err
 }
 
-func (d *DB) CheckAndInsertPost(ctx context.Context, p *Post) error {
-	logging.Info("Checking if post exists: %v", p.ID)
-	const existsQuery = `SELECT 1 FROM posts WHERE id = $1`
-	row := d.db.QueryRowContext(ctx, existsQuery, p.ID)
-	var dummy int
-	err := row.Scan(&dummy)
-	switch {
-	case err == sql.ErrNoRows:
-		logging.Error("Post does not exist, inserting: %v", p.ID)
-		return d.CreatePost(ctx, p)
-	case err != nil:
-		logging.Error("Error checking post existence: %v", err)
+// newestVersions drops duplicate posts, keeping the one with the highest change_seq.
+// A single INSERT ... ON CONFLICT can't update the same row twice.
+func newestVersions(posts []*Post) []*Post {
+	index := map[int]int{}
+	result := make([]*Post, 0, len(posts))
+	for _, p := range posts {
+		if i, ok := index[p.ID]; ok {
+			if result[i].ChangeSeq <= p.ChangeSeq {
+				result[i] = p
+			}
+			continue
+		}
+		index[p.ID] = len(result)
+		result = append(result, p)
+	}
+	return result
+}
+
+// insertRevision saves what changed between the stored and the incoming version of a post.
+func insertRevision(ctx context.Context, tx *sql.Tx, old, new *Post) error {
+	changes, err := json.Marshal(diffPosts(old, new))
+	if err != nil {
 		return err
-	default:
-		// Row exists, nothing to do
-		return nil
 	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO post_revisions (post_id, recorded_at, updated_at, old_change_seq, new_change_seq, changes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, new.ID, time.Now(), new.UpdatedAt, old.ChangeSeq, new.ChangeSeq, changes)
+	return err
+}
+
+// GetPostRevisions returns the recorded revisions of a post, newest first.
+func (d *sqlDB) GetPostRevisions(ctx context.Context, postID int64) ([]PostRevision, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT id, post_id, recorded_at, updated_at, old_change_seq, new_change_seq, changes
+		FROM post_revisions WHERE post_id = $1
+		ORDER BY new_change_seq DESC, id DESC
+	`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []PostRevision{}
+	for rows.Next() {
+		var r PostRevision
+		var changes []byte
+		if err := rows.Scan(&r.ID, &r.PostID, &r.RecordedAt, &r.UpdatedAt, &r.OldChangeSeq, &r.NewChangeSeq, &changes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &r.Changes); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
 }
 
-func (d *DB) SaveComments(comments []Comment) error {
+func (d *sqlDB) SaveComments(comments []Comment) error {
 	const query = `
 		INSERT INTO comments (
 			id, created_at, post_id, creator_id, body, score,
 			updated_at, updater_id, do_not_bump_post, is_hidden, is_sticky,
-			warning_type, warning_user_id, creator_name, updater_name
+			warning_type, warning_user_id, creator_name, updater_name, ` + archiveColumns + `
 		) VALUES (
 			$1, $2, $3, $4, $5, $6,
 			$7, $8, $9, $10, $11, $12,
-			$13, $14, $15
+			$13, $14, $15, $16, $17, $18
 		)
-		ON CONFLICT (id) DO NOTHING
+		ON CONFLICT (id) DO UPDATE SET
+			body = EXCLUDED.body, score = EXCLUDED.score,
+			updated_at = EXCLUDED.updated_at, updater_id = EXCLUDED.updater_id,
+			do_not_bump_post = EXCLUDED.do_not_bump_post, is_hidden = EXCLUDED.is_hidden, is_sticky = EXCLUDED.is_sticky,
+			warning_type = EXCLUDED.warning_type, warning_user_id = EXCLUDED.warning_user_id,
+			creator_name = EXCLUDED.creator_name, updater_name = EXCLUDED.updater_name,
+			raw = COALESCE(EXCLUDED.raw, comments.raw), fetched_at = COALESCE(EXCLUDED.fetched_at, comments.fetched_at),
+			source_url = COALESCE(EXCLUDED.source_url, comments.source_url)
 	`
 
 	stmt, err := d.db.Prepare(query)
@@ -124,7 +459,7 @@ func (d *DB) SaveComments(comments []Comment) error {
 	defer stmt.Close()
 
 	for _, c := range comments {
-		_, err := stmt.Exec(
+		args := []any{
 			c.ID,
 			c.CreatedAt,
 			c.PostID,
@@ -140,7 +475,8 @@ func (d *DB) SaveComments(comments []Comment) error {
 			c.WarningUserID,
 			c.CreatorName,
 			c.UpdaterName,
-		)
+		}
+		_, err := stmt.Exec(append(args, archiveValues(c.Archived)...)...)
 		if err != nil {
 			logging.Error("%v", err.Error())
 			return err
@@ -150,89 +486,19 @@ func (d *DB) SaveComments(comments []Comment) error {
 	return nil
 }
 
-func (d *DB) GetPost(ctx context.Context, id int64) (*Post, error) {
-	query := `
-	SELECT
-		id, created_at, updated_at,
-		file_width, file_height, file_ext, file_size, file_md5, file_url,
-		preview_width, preview_height, preview_url,
-		sample_has, sample_width, sample_height, sample_url,
-		score_up, score_down, score_total,
-		tags_general, tags_species, tags_character, tags_artist, tags_invalid, tags_lore, tags_meta,
-		locked_tags, change_seq,
-		flags_pending, flags_flagged, flags_note_locked, flags_status_locked, flags_rating_locked, flags_deleted,
-		rating, fav_count, sources, pools,
-		parent_id, has_children, has_active_children, children,
-		approver_id, uploader_id, description, comment_count, is_favorited
-	FROM posts WHERE id = $1
-	`
-	row := d.db.QueryRowContext(ctx, query, id)
-	p := &Post{}
-
-	err := row.Scan(
-		&p.ID, &p.CreatedAt, &p.UpdatedAt,
-		&p.File.Width, &p.File.Height, &p.File.Ext, &p.File.Size, &p.File.MD5, &p.File.URL,
-		&p.Preview.Width, &p.Preview.Height, &p.Preview.URL,
-		&p.Sample.Has, &p.Sample.Width, &p.Sample.Height, &p.Sample.URL,
-		&p.Score.Up, &p.Score.Down, &p.Score.Total,
-		pq.Array(&p.Tags.General), pq.Array(&p.Tags.Species), pq.Array(&p.Tags.Character),
-		pq.Array(&p.Tags.Artist), pq.Array(&p.Tags.Invalid), pq.Array(&p.Tags.Lore), pq.Array(&p.Tags.Meta),
-		pq.Array(&p.LockedTags), &p.ChangeSeq,
-		&p.Flags.Pending, &p.Flags.Flagged, &p.Flags.NoteLocked, &p.Flags.StatusLocked, &p.Flags.RatingLocked, &p.Flags.Deleted,
-		&p.Rating, &p.FavCount, pq.Array(&p.Sources), pq.Array(&p.Pools),
-		&p.Relationships.ParentID, &p.Relationships.HasChildren, &p.Relationships.HasActiveChildren, pq.Array(&p.Relationships.Children),
-		&p.ApproverID, &p.UploaderID, &p.Description, &p.CommentCount, &p.IsFavorited,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return p, nil
+func (d *sqlDB) GetPost(ctx context.Context, id int64) (*Post, error) {
+	row := d.db.QueryRowContext(ctx, `SELECT `+postColumns+` FROM posts WHERE id = $1`, id)
+	return d.scanPost(row)
 }
 
-func (d *DB) UpdatePost(ctx context.Context, p *Post) error {
-	p.UpdatedAt = time.Now()
-
-	query := `
-	UPDATE posts SET
-		created_at = $2, updated_at = $3,
-		file_width = $4, file_height = $5, file_ext = $6, file_size = $7, file_md5 = $8, file_url = $9,
-		preview_width = $10, preview_height = $11, preview_url = $12,
-		sample_has = $13, sample_width = $14, sample_height = $15, sample_url = $16,
-		score_up = $17, score_down = $18, score_total = $19,
-		tags_general = $20, tags_species = $21, tags_character = $22, tags_artist = $23,
-		tags_invalid = $24, tags_lore = $25, tags_meta = $26,
-		locked_tags = $27, change_seq = $28,
-		flags_pending = $29, flags_flagged = $30, flags_note_locked = $31, flags_status_locked = $32,
-		flags_rating_locked = $33, flags_deleted = $34,
-		rating = $35, fav_count = $36, sources = $37, pools = $38,
-		parent_id = $39, has_children = $40, has_active_children = $41, children = $42,
-		approver_id = $43, uploader_id = $44, description = $45, comment_count = $46, is_favorited = $47
-	WHERE id = $1
-	`
-	_, err := d.db.ExecContext(
-		ctx,
-		query,
-		p.ID, p.CreatedAt, p.UpdatedAt,
-		p.File.Width, p.File.Height, p.File.Ext, p.File.Size, p.File.MD5, p.File.URL,
-		p.Preview.Width, p.Preview.Height, p.Preview.URL,
-		p.Sample.Has, p.Sample.Width, p.Sample.Height, p.Sample.URL,
-		p.Score.Up, p.Score.Down, p.Score.Total,
-		pq.Array(p.Tags.General), pq.Array(p.Tags.Species), pq.Array(p.Tags.Character),
-		pq.Array(p.Tags.Artist), pq.Array(p.Tags.Invalid), pq.Array(p.Tags.Lore), pq.Array(p.Tags.Meta),
-		pq.Array(p.LockedTags), p.ChangeSeq,
-		p.Flags.Pending, p.Flags.Flagged, p.Flags.NoteLocked, p.Flags.StatusLocked, p.Flags.RatingLocked, p.Flags.Deleted,
-		p.Rating, p.FavCount, pq.Array(p.Sources), pq.Array(p.Pools),
-		p.Relationships.ParentID, p.Relationships.HasChildren, p.Relationships.HasActiveChildren, pq.Array(p.Relationships.Children),
-		p.ApproverID, p.UploaderID, p.Description, p.CommentCount, p.IsFavorited,
-	)
-	if err != nil {
-		logging.Error("Error updating post: %v", err)
-	}
-	return err
+// GetPostByMD5 returns the newest post with the given file md5.
+func (d *sqlDB) GetPostByMD5(ctx context.Context, md5 string) (*Post, error) {
+	row := d.db.QueryRowContext(ctx, `SELECT `+postColumns+` FROM posts WHERE file_md5 = $1 ORDER BY id DESC LIMIT 1`, md5)
+	return d.scanPost(row)
 }
 
 // DeletePost removes a post by its ID.
-func (d *DB) DeletePost(ctx context.Context, id int64) error {
+func (d *sqlDB) DeletePost(ctx context.Context, id int64) error {
 	_, err := d.db.ExecContext(ctx, `DELETE FROM posts WHERE id = $1`, id)
 	if err != nil {
 		logging.Error("Error deleting post: %v", err)
@@ -240,13 +506,13 @@ func (d *DB) DeletePost(ctx context.Context, id int64) error {
 	return err
 }
 
-func (d *DB) UpdatePool(ctx context.Context, p *Pool) error {
+func (d *sqlDB) UpdatePool(ctx context.Context, p *Pool) error {
 	query := `
 		INSERT INTO pools (
 			id, name, created_at, updated_at, creator_id, creator_name,
-			description, is_active, category, post_count
+			description, is_active, category, post_count, ` + archiveColumns + `
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 		ON CONFLICT(id) DO UPDATE SET
 			name = EXCLUDED.name,
 			created_at = EXCLUDED.created_at,
@@ -256,7 +522,10 @@ func (d *DB) UpdatePool(ctx context.Context, p *Pool) error {
 			description = EXCLUDED.description,
 			is_active = EXCLUDED.is_active,
 			category = EXCLUDED.category,
-			post_count = EXCLUDED.post_count
+			post_count = EXCLUDED.post_count,
+			raw = COALESCE(EXCLUDED.raw, pools.raw),
+			fetched_at = COALESCE(EXCLUDED.fetched_at, pools.fetched_at),
+			source_url = COALESCE(EXCLUDED.source_url, pools.source_url)
 	`
 
 	tx, err := d.db.BeginTx(ctx, nil)
@@ -265,10 +534,11 @@ func (d *DB) UpdatePool(ctx context.Context, p *Pool) error {
 	}
 	defer tx.Rollback()
 
-	_, err = tx.ExecContext(ctx, query,
+	args := []any{
 		p.ID, p.Name, p.CreatedAt, p.UpdatedAt, p.CreatorID, p.CreatorName,
 		p.Description, p.IsActive, p.Category, p.PostCount,
-	)
+	}
+	_, err = tx.ExecContext(ctx, query, append(args, archiveValues(p.Archived)...)...)
 	if err != nil {
 		logging.Error("error upserting pool: %v", err)
 		return err
@@ -280,8 +550,8 @@ func (d *DB) UpdatePool(ctx context.Context, p *Pool) error {
 		return err
 	}
 
-	for _, postID := range p.PostIDs {
-		_, err = tx.ExecContext(ctx, `INSERT INTO pool_posts (pool_id, post_id) VALUES ($1, $2)`, p.ID, postID)
+	for i, postID := range p.PostIDs {
+		_, err = tx.ExecContext(ctx, `INSERT INTO pool_posts (pool_id, post_id, position) VALUES ($1, $2, $3)`, p.ID, postID, i)
 		if err != nil {
 			logging.Error("error inserting pool_post: %v", err)
 			return err
@@ -291,47 +561,63 @@ func (d *DB) UpdatePool(ctx context.Context, p *Pool) error {
 	return tx.Commit()
 }
 
-func (d *DB) SearchPosts(ctx context.Context, minScoreTotal int, rating string, tagsToSearch []string, limit, offset int) ([]*Post, error) {
+// GetPool returns a pool together with the IDs of the posts in it, in pool order.
+func (d *sqlDB) GetPool(ctx context.Context, id int64) (*Pool, error) {
+	query := `
+	SELECT id, name, created_at, updated_at, creator_id, creator_name,
+		description, is_active, category, post_count
+	FROM pools WHERE id = $1
+	`
+	p := &Pool{}
+	var creatorName, description, category sql.NullString
+	var postCount sql.NullInt64
+
+	err := d.db.QueryRowContext(ctx, query, id).Scan(
+		&p.ID, &p.Name, &p.CreatedAt, &p.UpdatedAt, &p.CreatorID, &creatorName,
+		&description, &p.IsActive, &category, &postCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.CreatorName = creatorName.String
+	p.Description = description.String
+	p.Category = category.String
+	p.PostCount = int(postCount.Int64)
+
+	rows, err := d.db.QueryContext(ctx, `SELECT post_id FROM pool_posts WHERE pool_id = $1 ORDER BY position, post_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	p.PostIDs = []int{}
+	for rows.Next() {
+		var postID int
+		if err := rows.Scan(&postID); err != nil {
+			return nil, err
+		}
+		p.PostIDs = append(p.PostIDs, postID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SearchPosts runs an e621 tag query against the archive.
+func (d *sqlDB) SearchPosts(ctx context.Context, q *tagquery.Query, limit, offset int) ([]*Post, error) {
+	compiled := d.dialect.search(q, 1)
+	paramIndex := len(compiled.Args) + 1
+
 	// Base query
 	queryBuilder := strings.Builder{}
-	queryBuilder.WriteString(`
-	SELECT
-		id, created_at, updated_at,
-		file_width, file_height, file_ext, file_size, file_md5, file_url,
-		preview_width, preview_height, preview_url,
-		sample_has, sample_width, sample_height, sample_url,
-		score_up, score_down, score_total,
-		tags_general, tags_species, tags_character, tags_artist, tags_invalid, tags_lore, tags_meta,
-		locked_tags, change_seq,
-		flags_pending, flags_flagged, flags_note_locked, flags_status_locked, flags_rating_locked, flags_deleted,
-		rating, fav_count, sources, pools,
-		parent_id, has_children, has_active_children, children,
-		approver_id, uploader_id, description, comment_count, is_favorited
-	FROM posts
-	WHERE 1=1`)
-
-	args := []any{}
-	paramIndex := 1
-
-	if minScoreTotal != 0 {
-		queryBuilder.WriteString(fmt.Sprintf(" AND score_total >= $%d", paramIndex))
-		args = append(args, minScoreTotal)
-		paramIndex++
-	}
-
-	if rating != "" {
-		queryBuilder.WriteString(fmt.Sprintf(" AND rating = $%d", paramIndex))
-		args = append(args, rating)
-		paramIndex++
-	}
-
-	if len(tagsToSearch) > 0 {
-		queryBuilder.WriteString(fmt.Sprintf(" AND tags_general @> $%d", paramIndex))
-		args = append(args, pq.Array(tagsToSearch))
-		paramIndex++
-	}
-
-	queryBuilder.WriteString(fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1))
+	queryBuilder.WriteString(`SELECT ` + postColumns + ` FROM posts
+	WHERE `)
+	queryBuilder.WriteString(compiled.Where)
+
+	args := compiled.Args
+
+	queryBuilder.WriteString(fmt.Sprintf(" ORDER BY %s LIMIT $%d OFFSET $%d", compiled.OrderBy, paramIndex, paramIndex+1))
 	args = append(args, limit, offset)
 
 	rows, err := d.db.QueryContext(ctx, queryBuilder.String(), args...)
@@ -342,21 +628,7 @@ func (d *DB) SearchPosts(ctx context.Context, minScoreTotal int, rating string,
 
 	var results []*Post
 	for rows.Next() {
-		p := &Post{}
-		err := rows.Scan(
-			&p.ID, &p.CreatedAt, &p.UpdatedAt,
-			&p.File.Width, &p.File.Height, &p.File.Ext, &p.File.Size, &p.File.MD5, &p.File.URL,
-			&p.Preview.Width, &p.Preview.Height, &p.Preview.URL,
-			&p.Sample.Has, &p.Sample.Width, &p.Sample.Height, &p.Sample.URL,
-			&p.Score.Up, &p.Score.Down, &p.Score.Total,
-			pq.Array(&p.Tags.General), pq.Array(&p.Tags.Species), pq.Array(&p.Tags.Character),
-			pq.Array(&p.Tags.Artist), pq.Array(&p.Tags.Invalid), pq.Array(&p.Tags.Lore), pq.Array(&p.Tags.Meta),
-			pq.Array(&p.LockedTags), &p.ChangeSeq,
-			&p.Flags.Pending, &p.Flags.Flagged, &p.Flags.NoteLocked, &p.Flags.StatusLocked, &p.Flags.RatingLocked, &p.Flags.Deleted,
-			&p.Rating, &p.FavCount, pq.Array(&p.Sources), pq.Array(&p.Pools),
-			&p.Relationships.ParentID, &p.Relationships.HasChildren, &p.Relationships.HasActiveChildren, pq.Array(&p.Relationships.Children),
-			&p.ApproverID, &p.UploaderID, &p.Description, &p.CommentCount, &p.IsFavorited,
-		)
+		p, err := d.scanPost(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -367,3 +639,568 @@ func (d *DB) SearchPosts(ctx context.Context, minScoreTotal int, rating string,
 	}
 	return results, nil
 }
+
+// RawPayload is an archived upstream JSON document, see Archived.
+type RawPayload struct {
+	ID        int64
+	Raw       json.RawMessage
+	FetchedAt time.Time
+	SourceURL string
+}
+
+// archiveTables are the tables with archiveColumns.
+var archiveTables = []string{"posts", "pools", "comments"}
+
+// RawPayloads returns up to limit archived documents of posts, pools or comments with an ID above afterID, ordered by ID.
+// Rows saved before the archive existed have none and are skipped.
+func (d *sqlDB) RawPayloads(ctx context.Context, table string, afterID int64, limit int) ([]RawPayload, error) {
+	if !slices.Contains(archiveTables, table) {
+		return nil, fmt.Errorf("no archive in table %q", table)
+	}
+
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT id, raw, fetched_at, source_url FROM `+table+`
+		WHERE raw IS NOT NULL AND id > $1
+		ORDER BY id LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payloads []RawPayload
+	for rows.Next() {
+		var p RawPayload
+		var raw []byte
+		var fetchedAt sql.NullTime
+		var sourceURL sql.NullString
+		if err := rows.Scan(&p.ID, &raw, &fetchedAt, &sourceURL); err != nil {
+			return nil, err
+		}
+		p.Raw = raw
+		p.FetchedAt = fetchedAt.Time
+		p.SourceURL = sourceURL.String
+		payloads = append(payloads, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return payloads, nil
+}
+
+// TombstonePost records that a stored post vanished upstream, and returns it with its raw json. sql.ErrNoRows means we never had it.
+func (d *sqlDB) TombstonePost(ctx context.Context, id int64, reason string) (*Post, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	post, err := d.scanPost(tx.QueryRowContext(ctx, `SELECT `+postColumns+` FROM posts WHERE id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	var raw sql.NullString
+	if err := tx.QueryRowContext(ctx, `SELECT raw FROM posts WHERE id = $1`, id).Scan(&raw); err != nil {
+		return nil, err
+	}
+	post.Raw = json.RawMessage(raw.String)
+
+	state, err := json.Marshal(post)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordTombstone(ctx, tx, id, reason, state); err != nil {
+		return nil, err
+	}
+	return post, tx.Commit()
+}
+
+// Tombstones returns the posts that vanished since the given time, the most recent first.
+func (d *sqlDB) Tombstones(ctx context.Context, since time.Time, includeRestored bool, limit int) ([]Tombstone, error) {
+	query := `
+		SELECT post_id, reason, first_seen_at, last_seen_at, restored_at, last_state
+		FROM post_tombstones WHERE first_seen_at >= $1`
+	if !includeRestored {
+		query += ` AND restored_at IS NULL`
+	}
+	query += ` ORDER BY first_seen_at DESC, post_id DESC LIMIT $2`
+
+	rows, err := d.db.QueryContext(ctx, query, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tombstones := []Tombstone{}
+	for rows.Next() {
+		var t Tombstone
+		var restoredAt sql.NullTime
+		var state []byte
+		if err := rows.Scan(&t.PostID, &t.Reason, &t.FirstSeenAt, &t.LastSeenAt, &restoredAt, &state); err != nil {
+			return nil, err
+		}
+		if restoredAt.Valid {
+			t.RestoredAt = &restoredAt.Time
+		}
+		t.LastState = state
+		tombstones = append(tombstones, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+// StalePost is a post that is due for a refresh, see refresh.go.
+type StalePost struct {
+	ID        int64 `json:"id"`
+	Favorited *bool `json:"favorited,omitempty"` // what we know, anonymous refreshes don't
+}
+
+// StalePosts returns up to limit posts that were fetched before the given time, and weren't tried since either.
+// Posts whose last try failed are due right away, the job queue backs off by itself.
+// Pinned posts come first, then favorites, then the oldest ones. pinnedOnly skips everything that's neither.
+func (d *sqlDB) StalePosts(ctx context.Context, before time.Time, pinnedOnly bool, limit int) ([]StalePost, error) {
+	query := `
+		SELECT p.id, p.is_favorited FROM posts p
+		LEFT JOIN post_refresh r ON r.post_id = p.id
+		WHERE (p.fetched_at IS NULL OR p.fetched_at < $1)
+		AND (r.last_attempt_at IS NULL OR r.last_attempt_at < $1 OR r.last_status = $3)`
+	if pinnedOnly {
+		query += ` AND (COALESCE(r.pinned, FALSE) OR COALESCE(p.is_favorited, FALSE))`
+	}
+	// posts from before the archive have no fetched_at, those are the oldest
+	query += `
+		ORDER BY COALESCE(r.pinned, FALSE) DESC, COALESCE(p.is_favorited, FALSE) DESC,
+			p.fetched_at IS NOT NULL, p.fetched_at, p.id
+		LIMIT $2`
+
+	rows, err := d.db.QueryContext(ctx, query, before, limit, refreshError)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []StalePost
+	for rows.Next() {
+		var p StalePost
+		var favorited sql.NullBool
+		if err := rows.Scan(&p.ID, &favorited); err != nil {
+			return nil, err
+		}
+		if favorited.Valid {
+			p.Favorited = &favorited.Bool
+		}
+		posts = append(posts, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// RecordRefresh saves how refreshing posts went. message is the error, if there was one.
+func (d *sqlDB) RecordRefresh(ctx context.Context, ids []int64, status, message string) error {
+	var lastError any
+	if message != "" {
+		lastError = message
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO post_refresh (post_id, last_attempt_at, last_status, last_error)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (post_id) DO UPDATE SET
+				last_attempt_at = EXCLUDED.last_attempt_at, last_status = EXCLUDED.last_status, last_error = EXCLUDED.last_error
+		`, id, now, status, lastError)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PinPost makes a stored post get refreshed before all others, or stops that. sql.ErrNoRows means we don't have it.
+func (d *sqlDB) PinPost(ctx context.Context, id int64, pinned bool) error {
+	res, err := d.db.ExecContext(ctx, `
+		INSERT INTO post_refresh (post_id, pinned)
+		SELECT id, $2 FROM posts WHERE id = $1
+		ON CONFLICT (post_id) DO UPDATE SET pinned = EXCLUDED.pinned
+	`, id, pinned)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RefreshStatus is how the last refresh of a post went.
+type RefreshStatus struct {
+	PostID        int64      `json:"post_id"`
+	Pinned        bool       `json:"pinned"`
+	FetchedAt     *time.Time `json:"fetched_at,omitempty"` // when we last got it from upstream, by refresh or not
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	LastStatus    string     `json:"last_status,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// RefreshStatus returns the refresh status of a stored post. sql.ErrNoRows means we don't have it.
+func (d *sqlDB) RefreshStatus(ctx context.Context, id int64) (*RefreshStatus, error) {
+	var s RefreshStatus
+	var fetchedAt, lastAttemptAt sql.NullTime
+	var lastStatus, lastError sql.NullString
+	err := d.db.QueryRowContext(ctx, `
+		SELECT p.id, COALESCE(r.pinned, FALSE), p.fetched_at, r.last_attempt_at, r.last_status, r.last_error
+		FROM posts p LEFT JOIN post_refresh r ON r.post_id = p.id
+		WHERE p.id = $1
+	`, id).Scan(&s.PostID, &s.Pinned, &fetchedAt, &lastAttemptAt, &lastStatus, &lastError)
+	if err != nil {
+		return nil, err
+	}
+
+	if fetchedAt.Valid {
+		s.FetchedAt = &fetchedAt.Time
+	}
+	if lastAttemptAt.Valid {
+		s.LastAttemptAt = &lastAttemptAt.Time
+	}
+	s.LastStatus = lastStatus.String
+	s.LastError = lastError.String
+	return &s, nil
+}
+
+// Job is a piece of background work in the jobs table, see jobs.go.
+type Job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	DedupKey    string          `json:"dedup_key,omitempty"`
+	Priority    int             `json:"priority"`
+	State       string          `json:"state"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+const jobColumns = `id, kind, payload, dedup_key, priority, state, attempts, max_attempts, run_at, last_error, created_at, updated_at`
+
+func scanJob(row rowScanner) (*Job, error) {
+	var j Job
+	var payload []byte
+	var dedupKey, lastError sql.NullString
+	err := row.Scan(&j.ID, &j.Kind, &payload, &dedupKey, &j.Priority, &j.State, &j.Attempts, &j.MaxAttempts,
+		&j.RunAt, &lastError, &j.CreatedAt, &j.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	j.Payload = payload
+	j.DedupKey = dedupKey.String
+	j.LastError = lastError.String
+	return &j, nil
+}
+
+// EnqueueJobs adds jobs to the queue and returns how many were new.
+// Jobs with the dedup key of a job that is still queued or running are dropped.
+func (d *sqlDB) EnqueueJobs(ctx context.Context, jobs []Job) (int, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	added := 0
+	now := time.Now()
+	for _, j := range jobs {
+		var dedupKey any
+		if j.DedupKey != "" {
+			dedupKey = j.DedupKey
+		}
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO jobs (kind, payload, dedup_key, priority, state, max_attempts, run_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+			ON CONFLICT DO NOTHING
+		`, j.Kind, string(j.Payload), dedupKey, j.Priority, jobQueued, j.MaxAttempts, j.RunAt, now)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			added += int(n)
+		}
+	}
+	return added, tx.Commit()
+}
+
+// ClaimJob takes the next due job, highest priority first, and marks it as running until lease is over.
+// Running jobs with an expired lease were abandoned (by a crash, most likely), those are due again.
+// sql.ErrNoRows means there is nothing to do.
+func (d *sqlDB) ClaimJob(ctx context.Context, lease time.Duration) (*Job, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM jobs
+		WHERE (state = $1 AND run_at <= $3) OR (state = $2 AND locked_until < $3)
+		ORDER BY priority DESC, run_at, id
+		LIMIT 1`+d.dialect.skipLocked, jobQueued, jobRunning, now).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := scanJob(tx.QueryRowContext(ctx, `
+		UPDATE jobs SET state = $1, attempts = attempts + 1, locked_until = $2, updated_at = $3
+		WHERE id = $4
+		RETURNING `+jobColumns, jobRunning, now.Add(lease), now, id))
+	if err != nil {
+		return nil, err
+	}
+	return job, tx.Commit()
+}
+
+// FinishJob removes a job that is done.
+func (d *sqlDB) FinishJob(ctx context.Context, id int64) error {
+	_, err := d.db.ExecContext(ctx, `DELETE FROM jobs WHERE id = $1`, id)
+	return err
+}
+
+// FailJob queues a failed job again at retryAt, or, if that's nil, gives up on it.
+// Of the dead jobs with the same dedup key, only the latest is kept.
+func (d *sqlDB) FailJob(ctx context.Context, job *Job, message string, retryAt *time.Time) error {
+	now := time.Now()
+	if retryAt != nil {
+		_, err := d.db.ExecContext(ctx, `
+			UPDATE jobs SET state = $1, run_at = $2, locked_until = NULL, last_error = $3, updated_at = $4
+			WHERE id = $5
+		`, jobQueued, *retryAt, message, now, job.ID)
+		return err
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if job.DedupKey != "" {
+		_, err := tx.ExecContext(ctx, `DELETE FROM jobs WHERE dedup_key = $1 AND state = $2 AND id <> $3`, job.DedupKey, jobDead, job.ID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE jobs SET state = $1, locked_until = NULL, last_error = $2, updated_at = $3
+		WHERE id = $4
+	`, jobDead, message, now, job.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// JobCount is how many jobs of a kind are in a state.
+type JobCount struct {
+	Kind  string `json:"kind"`
+	State string `json:"state"`
+	Count int    `json:"count"`
+}
+
+// JobCounts returns how many jobs there are, by kind and state.
+func (d *sqlDB) JobCounts(ctx context.Context) ([]JobCount, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT kind, state, COUNT(*) FROM jobs
+		GROUP BY kind, state ORDER BY kind, state
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []JobCount{}
+	for rows.Next() {
+		var c JobCount
+		if err := rows.Scan(&c.Kind, &c.State, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// FailedJobs returns dead jobs and jobs waiting for a retry, the most recent failures first.
+func (d *sqlDB) FailedJobs(ctx context.Context, limit int) ([]Job, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		SELECT `+jobColumns+` FROM jobs
+		WHERE state = $1 OR (state = $2 AND last_error IS NOT NULL)
+		ORDER BY updated_at DESC, id DESC LIMIT $3
+	`, jobDead, jobQueued, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// RetryJobs queues dead jobs again with fresh attempts, and jobs waiting for a retry right away.
+// id 0 means all of them, kind limits them to one kind. Returns how many jobs were queued.
+// Dead jobs whose dedup key got queued again in the meantime stay dead.
+func (d *sqlDB) RetryJobs(ctx context.Context, id int64, kind string) (int64, error) {
+	query := `
+		UPDATE jobs SET
+			attempts = CASE WHEN state = $1 THEN 0 ELSE attempts END,
+			state = $2, run_at = $3, locked_until = NULL, updated_at = $3
+		WHERE (state = $1 OR (state = $2 AND last_error IS NOT NULL))
+		AND (state = $2 OR dedup_key IS NULL OR NOT EXISTS (
+			SELECT 1 FROM jobs other WHERE other.dedup_key = jobs.dedup_key AND other.state IN ($2, $4)
+		))`
+	args := []any{jobDead, jobQueued, time.Now(), jobRunning}
+	if id != 0 {
+		args = append(args, id)
+		query += fmt.Sprintf(` AND id = $%d`, len(args))
+	}
+	if kind != "" {
+		args = append(args, kind)
+		query += fmt.Sprintf(` AND kind = $%d`, len(args))
+	}
+
+	res, err := d.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ArchiveRun is the progress of archiving a tag search, pool, set or favorites, see archive.go.
+type ArchiveRun struct {
+	ID         int64      `json:"id"`
+	Target     string     `json:"target"`
+	State      string     `json:"state"`
+	BeforeID   int64      `json:"before_id"` // the next page is below this post id, 0 before the first page
+	Pages      int        `json:"pages"`
+	Posts      int        `json:"posts"`
+	LastError  string     `json:"last_error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+const archiveRunColumns = `id, target, state, before_id, pages, posts, last_error, created_at, updated_at, finished_at`
+
+func scanArchiveRun(row rowScanner) (*ArchiveRun, error) {
+	var r ArchiveRun
+	var lastError sql.NullString
+	var finishedAt sql.NullTime
+	err := row.Scan(&r.ID, &r.Target, &r.State, &r.BeforeID, &r.Pages, &r.Posts, &lastError, &r.CreatedAt, &r.UpdatedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	r.LastError = lastError.String
+	if finishedAt.Valid {
+		r.FinishedAt = &finishedAt.Time
+	}
+	return &r, nil
+}
+
+// StartArchiveRun returns the running run of target, or starts a new one.
+func (d *sqlDB) StartArchiveRun(ctx context.Context, target string) (*ArchiveRun, error) {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO archive_runs (target, state, created_at, updated_at) VALUES ($1, $2, $3, $3)
+		ON CONFLICT DO NOTHING
+	`, target, archiveRunning, now)
+	if err != nil {
+		return nil, err
+	}
+
+	run, err := scanArchiveRun(tx.QueryRowContext(ctx, `
+		SELECT `+archiveRunColumns+` FROM archive_runs WHERE target = $1 AND state = $2
+	`, target, archiveRunning))
+	if err != nil {
+		return nil, err
+	}
+	return run, tx.Commit()
+}
+
+// GetArchiveRun returns a run, sql.ErrNoRows if there is none with that ID.
+func (d *sqlDB) GetArchiveRun(ctx context.Context, id int64) (*ArchiveRun, error) {
+	return scanArchiveRun(d.db.QueryRowContext(ctx, `SELECT `+archiveRunColumns+` FROM archive_runs WHERE id = $1`, id))
+}
+
+// ArchiveRuns returns the latest runs, the newest first.
+func (d *sqlDB) ArchiveRuns(ctx context.Context, limit int) ([]ArchiveRun, error) {
+	rows, err := d.db.QueryContext(ctx, `SELECT `+archiveRunColumns+` FROM archive_runs ORDER BY id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []ArchiveRun{}
+	for rows.Next() {
+		r, err := scanArchiveRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, *r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// UpdateArchiveRun saves the progress of a run.
+func (d *sqlDB) UpdateArchiveRun(ctx context.Context, run *ArchiveRun) error {
+	var lastError any
+	if run.LastError != "" {
+		lastError = run.LastError
+	}
+	run.UpdatedAt = time.Now()
+
+	_, err := d.db.ExecContext(ctx, `
+		UPDATE archive_runs SET state = $1, before_id = $2, pages = $3, posts = $4, last_error = $5, updated_at = $6, finished_at = $7
+		WHERE id = $8
+	`, run.State, run.BeforeID, run.Pages, run.Posts, lastError, run.UpdatedAt, run.FinishedAt, run.ID)
+	return err
+}
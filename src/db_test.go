@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a migrated SQLite database in a temp dir, and makes it the Database.
+func openTestDB(t *testing.T) *sqlDB {
+	t.Helper()
+	db, err := newSQLiteDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	d := db.(*sqlDB)
+	t.Cleanup(func() { d.db.Close() })
+
+	migrator, err := d.Migrator()
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	Database = d
+	return d
+}
+
+func TestPoolOrder(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+
+	pool := &Pool{ID: 1, Name: "comic", CreatedAt: time.Now(), UpdatedAt: time.Now(), PostIDs: []int{30, 10, 20}}
+	if err := d.UpdatePool(ctx, pool); err != nil {
+		t.Fatalf("UpdatePool failed: %v", err)
+	}
+
+	got, err := d.GetPool(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetPool failed: %v", err)
+	}
+	if !slices.Equal(got.PostIDs, pool.PostIDs) {
+		t.Errorf("Expected the posts in pool order %v, got %v", pool.PostIDs, got.PostIDs)
+	}
+}
@@ -0,0 +1,309 @@
+package dualreader
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+var (
+	ErrSpoolFull = errors.New("tee: source is larger than the spool limit")
+	ErrClosed    = errors.New("tee: closed")
+)
+
+const defaultMemoryLimit = 4 * 1024 * 1024
+
+type TeeOptions struct {
+	MemoryLimit int64  // bytes kept in memory before spooling to a temp file, defaults to 4MB. -1 never uses a file
+	MaxSize     int64  // the source fails with ErrSpoolFull if it is larger than this, 0 means no limit
+	TempDir     string // where the spool file goes, defaults to os.TempDir()
+}
+
+// Sums are the hashes of everything the source delivered.
+type Sums struct {
+	Size   int64
+	MD5    string
+	SHA256 string
+}
+
+// Tee reads a source once and lets any number of readers read all of it, each at its own speed, even if they start after the source is half read.
+// What has been read is spooled in memory, and once that gets too big, in a temp file.
+// The source gets read as fast as it delivers, so a slow or stuck reader never holds back the others.
+type Tee struct {
+	opts   TeeOptions
+	source io.ReadCloser
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte   // spool while in memory
+	file *os.File // spool once it got too big for memory
+	size int64    // bytes spooled so far
+	done bool
+	err  error // error of the source, io.EOF if it ended normally
+	sums Sums
+
+	pumping bool
+	refs    int  // open readers, plus one for the Tee itself until it gets closed
+	closed  bool // Close was called
+	freed   bool
+}
+
+func NewTee(source io.ReadCloser, opts TeeOptions) *Tee {
+	if opts.MemoryLimit == 0 {
+		opts.MemoryLimit = defaultMemoryLimit
+	}
+
+	t := &Tee{opts: opts, source: source, pumping: true, refs: 1}
+	t.cond = sync.NewCond(&t.mu)
+
+	go t.pump()
+
+	return t
+}
+
+func (t *Tee) pump() {
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	hashes := io.MultiWriter(md5Hash, sha256Hash)
+
+	err := t.spool(hashes)
+	t.source.Close()
+
+	t.mu.Lock()
+	if t.refs == 0 && err != io.EOF {
+		// the source failed because release closed it
+		err = ErrClosed
+	}
+	t.mu.Unlock()
+
+	if err != io.EOF && !errors.Is(err, ErrClosed) {
+		log.Println("[Tee] error reading source:", err)
+	}
+
+	t.mu.Lock()
+	t.done = true
+	t.err = err
+	t.sums = Sums{Size: t.size, MD5: hexSum(md5Hash), SHA256: hexSum(sha256Hash)}
+	t.pumping = false
+	t.freeIfUnused()
+	t.mu.Unlock()
+	t.cond.Broadcast()
+}
+
+// spool copies the source into the spool until it ends, returning why it ended.
+func (t *Tee) spool(hashes io.Writer) error {
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := t.source.Read(chunk)
+
+		if n > 0 {
+			t.mu.Lock()
+			stopped := t.refs == 0
+			size := t.size
+			t.mu.Unlock()
+
+			// nobody can read it anymore
+			if stopped {
+				return ErrClosed
+			}
+
+			if t.opts.MaxSize > 0 && size+int64(n) > t.opts.MaxSize {
+				return ErrSpoolFull
+			}
+
+			hashes.Write(chunk[:n])
+			if werr := t.write(chunk[:n]); werr != nil {
+				return werr
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// write appends p to the spool. Only the pump calls it, so the file can be written without holding the lock.
+func (t *Tee) write(p []byte) error {
+	t.mu.Lock()
+	file := t.file
+
+	if file == nil && (t.opts.MemoryLimit < 0 || int64(len(t.buf)+len(p)) <= t.opts.MemoryLimit) {
+		t.buf = append(t.buf, p...)
+		t.size += int64(len(p))
+		t.mu.Unlock()
+		t.cond.Broadcast()
+		return nil
+	}
+	t.mu.Unlock()
+
+	// too big for memory, move the spool to a file. Readers keep reading from the old buffer until they get past it.
+	if file == nil {
+		f, err := os.CreateTemp(t.opts.TempDir, "e6-cache-spool-*")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(t.buf); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+
+		t.mu.Lock()
+		t.file = f
+		t.buf = nil
+		t.mu.Unlock()
+		file = f
+	}
+
+	if _, err := file.Write(p); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.size += int64(len(p))
+	t.mu.Unlock()
+	t.cond.Broadcast()
+	return nil
+}
+
+// NewReader returns a reader that starts at the beginning of the source.
+// It fails once the Tee has been closed and every reader is gone, because the spool is deleted then.
+func (t *Tee) NewReader() (io.ReadCloser, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.refs == 0 {
+		return nil, ErrClosed
+	}
+	t.refs++
+	return &teeReader{tee: t}, nil
+}
+
+// Sums waits for the source to end and returns its hashes, or the error it failed with.
+func (t *Tee) Sums() (Sums, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for !t.done {
+		t.cond.Wait()
+	}
+	if t.err != io.EOF {
+		return Sums{}, t.err
+	}
+	return t.sums, nil
+}
+
+// Close lets go of the Tee. The readers that are still open keep working,
+// and once they are closed too the source is stopped and the spool deleted.
+func (t *Tee) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	t.release()
+	return nil
+}
+
+// release drops one reference, must be called with the lock held.
+func (t *Tee) release() {
+	t.refs--
+	if t.refs > 0 {
+		return
+	}
+
+	// nobody is left to read, stop the source instead of downloading it for nothing
+	if t.pumping {
+		t.source.Close()
+	}
+	t.freeIfUnused()
+}
+
+// freeIfUnused deletes the spool once the source and every reader are done with it, must be called with the lock held.
+func (t *Tee) freeIfUnused() {
+	if t.pumping || t.refs > 0 || t.freed {
+		return
+	}
+	t.freed = true
+	t.buf = nil
+	if t.file != nil {
+		t.file.Close()
+		os.Remove(t.file.Name())
+	}
+}
+
+type teeReader struct {
+	tee    *Tee
+	offset int64
+	closed bool
+}
+
+func (r *teeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	t := r.tee
+	t.mu.Lock()
+	for !r.closed && r.offset >= t.size && !t.done {
+		t.cond.Wait()
+	}
+
+	if r.closed {
+		t.mu.Unlock()
+		return 0, ErrClosed
+	}
+	if r.offset >= t.size {
+		err := t.err
+		t.mu.Unlock()
+		return 0, err
+	}
+
+	available := t.size - r.offset
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	buf, file := t.buf, t.file
+	t.mu.Unlock()
+
+	// spooled bytes never change, so they can be read without the lock
+	var n int
+	var err error
+	if file == nil {
+		n = copy(p, buf[r.offset:])
+	} else {
+		n, err = file.ReadAt(p, r.offset)
+		if err == io.EOF && n == len(p) {
+			err = nil
+		}
+	}
+	r.offset += int64(n)
+	return n, err
+}
+
+// Close stops this reader, the source and the other readers keep going.
+func (r *teeReader) Close() error {
+	t := r.tee
+	t.mu.Lock()
+	if r.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	t.release()
+	t.mu.Unlock()
+	t.cond.Broadcast()
+	return nil
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
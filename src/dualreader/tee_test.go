@@ -0,0 +1,276 @@
+package dualreader
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func randomInput(t *testing.T, size int) []byte {
+	t.Helper()
+	input := make([]byte, size)
+	if _, err := rand.Read(input); err != nil {
+		t.Fatalf("Failed to generate random input: %v", err)
+	}
+	return input
+}
+
+// chunkedSource delivers input in chunks through a pipe, so readers attach while the source is still going.
+func chunkedSource(input []byte, chunk int) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < len(input); i += chunk {
+			if _, err := pw.Write(input[i:min(i+chunk, len(input))]); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+func newReader(t *testing.T, tee *Tee) io.ReadCloser {
+	t.Helper()
+	r, err := tee.NewReader()
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	return r
+}
+
+func spoolFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read spool dir: %v", err)
+	}
+	return len(entries)
+}
+
+func TestTee(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		memoryLimit int64
+		spoolFiles  int
+	}{
+		{"memory", -1, 0},
+		{"file", 1000 * 1000, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			input := randomInput(t, 10*1000*1000) // 10MB
+			dir := t.TempDir()
+
+			tee := NewTee(chunkedSource(input, 100*1000), TeeOptions{MemoryLimit: tt.memoryLimit, TempDir: dir})
+			first := newReader(t, tee)
+
+			// read a bit before the second reader shows up
+			head := make([]byte, 1000)
+			if _, err := io.ReadFull(first, head); err != nil {
+				t.Fatalf("Failed to read head: %v", err)
+			}
+			second := newReader(t, tee)
+
+			// a reader that gives up early must not affect the others
+			quitter := newReader(t, tee)
+			quitter.Read(make([]byte, 10))
+			quitter.Close()
+			if _, err := quitter.Read(make([]byte, 10)); !errors.Is(err, ErrClosed) {
+				t.Errorf("Expected ErrClosed reading a closed reader, got %v", err)
+			}
+
+			// read both at the same time, with small reads so they don't stay in step
+			var wg sync.WaitGroup
+			var rest []byte
+			var all bytes.Buffer
+			var err1, err2 error
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				rest, err1 = io.ReadAll(first)
+			}()
+			go func() {
+				defer wg.Done()
+				_, err2 = io.CopyBuffer(&all, second, make([]byte, 777))
+			}()
+			wg.Wait()
+
+			if err1 != nil || err2 != nil {
+				t.Fatalf("Read errors: %v, %v", err1, err2)
+			}
+			if !bytes.Equal(append(head, rest...), input) {
+				t.Errorf("Reader 1 output mismatch")
+			}
+			if !bytes.Equal(all.Bytes(), input) {
+				t.Errorf("Reader 2 output mismatch")
+			}
+
+			if got := spoolFiles(t, dir); got != tt.spoolFiles {
+				t.Errorf("Expected %d spool files, got %d", tt.spoolFiles, got)
+			}
+
+			// late readers still get everything
+			late, err := io.ReadAll(newReader(t, tee))
+			if err != nil || !bytes.Equal(late, input) {
+				t.Errorf("Late reader output mismatch: %v", err)
+			}
+
+			sums, err := tee.Sums()
+			if err != nil {
+				t.Fatalf("Sums failed: %v", err)
+			}
+			md5Sum, sha256Sum := md5.Sum(input), sha256.Sum256(input)
+			if sums.Size != int64(len(input)) || sums.MD5 != hex.EncodeToString(md5Sum[:]) || sums.SHA256 != hex.EncodeToString(sha256Sum[:]) {
+				t.Errorf("Unexpected sums: %+v", sums)
+			}
+		})
+	}
+}
+
+func TestTeeSpoolDeleted(t *testing.T) {
+	input := randomInput(t, 100*1000)
+	dir := t.TempDir()
+
+	tee := NewTee(io.NopCloser(bytes.NewReader(input)), TeeOptions{MemoryLimit: 1000, TempDir: dir})
+	r := newReader(t, tee)
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatalf("Read error: %v", err)
+	}
+
+	// the Tee is closed, but the reader is still open
+	tee.Close()
+	if got := spoolFiles(t, dir); got != 1 {
+		t.Errorf("Spool deleted while a reader was still open")
+	}
+	late := newReader(t, tee)
+
+	r.Close()
+	late.Close()
+	if got := spoolFiles(t, dir); got != 0 {
+		t.Errorf("Spool not deleted after every reader was closed")
+	}
+
+	if _, err := tee.NewReader(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from NewReader after the spool was deleted, got %v", err)
+	}
+}
+
+func TestTeeStuckReader(t *testing.T) {
+	input := randomInput(t, 1000*1000)
+
+	tee := NewTee(chunkedSource(input, 1000), TeeOptions{TempDir: t.TempDir()})
+	defer tee.Close()
+
+	// never reads, must not hold back the source or the other reader
+	stuck := newReader(t, tee)
+	defer stuck.Close()
+
+	r := newReader(t, tee)
+	defer r.Close()
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+
+	select {
+	case data := <-done:
+		if !bytes.Equal(data, input) {
+			t.Errorf("Output mismatch")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Reader was held back by a reader that doesn't read")
+	}
+}
+
+func TestTeeCloseUnblocksRead(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	tee := NewTee(pr, TeeOptions{})
+	defer tee.Close()
+	r := newReader(t, tee)
+
+	errs := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		errs <- err
+	}()
+
+	// the source never sends anything, so the read blocks until the reader is closed
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Close didn't unblock Read")
+	}
+}
+
+func TestTeeStopsSource(t *testing.T) {
+	pr, pw := io.Pipe()
+
+	tee := NewTee(pr, TeeOptions{})
+	r := newReader(t, tee)
+	pw.Write([]byte("hello"))
+
+	// once nobody can read anymore, the source gets closed
+	r.Close()
+	tee.Close()
+
+	if _, err := pw.Write([]byte("world")); err == nil {
+		t.Errorf("Expected the source to be closed")
+	}
+	if _, err := tee.Sums(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Sums, got %v", err)
+	}
+}
+
+func TestTeeSourceError(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("partial"))
+		pw.CloseWithError(errors.New("connection reset"))
+	}()
+
+	tee := NewTee(pr, TeeOptions{})
+	defer tee.Close()
+
+	data, err := io.ReadAll(newReader(t, tee))
+	if err == nil || err.Error() != "connection reset" {
+		t.Errorf("Expected the source error, got %v", err)
+	}
+	if string(data) != "partial" {
+		t.Errorf("Expected the data before the error, got %q", data)
+	}
+	if _, err := tee.Sums(); err == nil {
+		t.Errorf("Expected Sums to fail after a source error")
+	}
+}
+
+func TestTeeMaxSize(t *testing.T) {
+	input := randomInput(t, 10*1000)
+
+	tee := NewTee(chunkedSource(input, 1000), TeeOptions{MaxSize: 5000})
+	defer tee.Close()
+
+	data, err := io.ReadAll(newReader(t, tee))
+	if !errors.Is(err, ErrSpoolFull) {
+		t.Errorf("Expected ErrSpoolFull, got %v", err)
+	}
+	if !bytes.Equal(data, input[:5000]) {
+		t.Errorf("Expected the data up to the limit, got %d bytes", len(data))
+	}
+}
@@ -1,6 +1,26 @@
 package main
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Archived is the upstream JSON an entity was decoded from, stored next to its typed columns.
+// Nothing of it is sent to clients, they get upstream's response itself.
+type Archived struct {
+	Raw       json.RawMessage `json:"-"` // set by UnmarshalJSON
+	FetchedAt time.Time       `json:"-"`
+	SourceURL string          `json:"-"` // upstream url it came from, without credentials
+}
+
+// setFetched records where and when the entity was fetched.
+func (a *Archived) setFetched(at time.Time, sourceURL string) {
+	a.FetchedAt = at
+	a.SourceURL = sourceURL
+}
 
 type Post struct {
 	ID            int           `json:"id"`
@@ -24,6 +44,20 @@ type Post struct {
 	Description   string        `json:"description"`
 	CommentCount  int           `json:"comment_count"`
 	IsFavorited   *bool         `json:"is_favorited,omitempty"` // nullable, only if auth provided
+
+	// fetched with a login. Anonymous users also get null file urls for posts on the global blacklist, see vanishReason
+	Authenticated bool `json:"-"`
+
+	Archived
+}
+
+func (p *Post) UnmarshalJSON(data []byte) error {
+	type plain Post // without this method
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	p.Raw = bytes.Clone(data)
+	return nil
 }
 
 type PostsResponse struct {
@@ -54,6 +88,17 @@ type Comment struct {
 	WarningUserID *int64    `json:"warning_user_id"`
 	CreatorName   string    `json:"creator_name"`
 	UpdaterName   string    `json:"updater_name"`
+
+	Archived
+}
+
+func (c *Comment) UnmarshalJSON(data []byte) error {
+	type plain Comment
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	c.Raw = bytes.Clone(data)
+	return nil
 }
 
 type File struct {
@@ -72,12 +117,84 @@ type Preview struct {
 }
 
 type Sample struct {
-	Has    bool   `json:"has"`
+	Has        bool       `json:"has"`
+	Width      int        `json:"width"`
+	Height     int        `json:"height"`
+	URL        string     `json:"url"`
+	Alternates Alternates `json:"alternates"`
+}
+
+// Alternates are the video versions of a post by name, like 480p, 720p and original.
+type Alternates map[string]Alternate
+
+type Alternate struct {
+	Type   string   `json:"type"` // video
+	Width  int      `json:"width"`
+	Height int      `json:"height"`
+	URLs   []string `json:"urls"` // webm and mp4, "" if there is none
+}
+
+// alternateFile is one file in the current shape of sample.alternates, which has a url per file:
+// {has, original: file, variants: {mp4: file}, samples: {480p: file}}
+type alternateFile struct {
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
 	URL    string `json:"url"`
 }
 
+// UnmarshalJSON reads both the old {name: {type, width, height, urls}} and the current shape of sample.alternates.
+// In the current one, original and its variants (other formats of the same video) end up as "original", and samples by their name.
+// It skips entries that aren't alternates, so a format change upstream doesn't make whole posts fail to decode.
+// Whatever gets skipped is still in the raw json.
+func (a *Alternates) UnmarshalJSON(data []byte) error {
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		*a = nil
+		return nil
+	}
+
+	*a = Alternates{}
+	for name, entry := range entries {
+		var alternate Alternate
+		if err := json.Unmarshal(entry, &alternate); err != nil || alternate.URLs == nil {
+			continue
+		}
+		(*a)[name] = alternate
+	}
+
+	var original alternateFile
+	if err := json.Unmarshal(entries["original"], &original); err == nil {
+		a.add("original", original)
+	}
+	for _, group := range []string{"variants", "samples"} {
+		var files map[string]alternateFile
+		if err := json.Unmarshal(entries[group], &files); err != nil {
+			continue
+		}
+		for _, key := range slices.Sorted(maps.Keys(files)) {
+			name := key
+			if group == "variants" {
+				name = "original"
+			}
+			a.add(name, files[key])
+		}
+	}
+	return nil
+}
+
+// add adds a file of the current shape to the alternate called name.
+func (a Alternates) add(name string, file alternateFile) {
+	if file.URL == "" {
+		return
+	}
+	alternate, ok := a[name]
+	if !ok {
+		alternate = Alternate{Type: "video", Width: file.Width, Height: file.Height}
+	}
+	alternate.URLs = append(alternate.URLs, file.URL)
+	a[name] = alternate
+}
+
 type Score struct {
 	Up    int `json:"up"`
 	Down  int `json:"down"`
@@ -111,15 +228,26 @@ type Relationships struct {
 }
 
 type Pool struct {
-	ID          int       `db:"id"`
-	Name        string    `db:"name"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
-	CreatorID   int       `db:"creator_id"`
-	CreatorName string    `db:"creator_name"`
-	Description string    `db:"description"`
-	IsActive    bool      `db:"is_active"`
-	Category    string    `db:"category"`
-	PostCount   int       `db:"post_count"`
-	PostIDs     []int     // not in DB directly
+	ID          int       `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	CreatorID   int       `json:"creator_id" db:"creator_id"`
+	CreatorName string    `json:"creator_name" db:"creator_name"`
+	Description string    `json:"description" db:"description"`
+	IsActive    bool      `json:"is_active" db:"is_active"`
+	Category    string    `json:"category" db:"category"`
+	PostCount   int       `json:"post_count" db:"post_count"`
+	PostIDs     []int     `json:"post_ids"` // not in DB directly
+
+	Archived
+}
+
+func (p *Pool) UnmarshalJSON(data []byte) error {
+	type plain Pool
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	p.Raw = bytes.Clone(data)
+	return nil
 }
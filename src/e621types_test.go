@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"testing"
+)
+
+func loadTestPosts(t *testing.T) ([]byte, PostsResponse) {
+	t.Helper()
+	body, err := os.ReadFile("jsonrewrite/testdata/posts.json")
+	if err != nil {
+		t.Fatalf("Failed to read test posts: %v", err)
+	}
+	var posts PostsResponse
+	if err := json.Unmarshal(body, &posts); err != nil {
+		t.Fatalf("Failed to decode test posts: %v", err)
+	}
+	return body, posts
+}
+
+func TestAlternates(t *testing.T) {
+	_, posts := loadTestPosts(t)
+	base := "https://static1.e621.net/data/"
+
+	for _, tt := range []struct {
+		name       string
+		alternates Alternates
+		want       map[string][]string
+	}{
+		{
+			name:       "current shape",
+			alternates: posts.Posts[0].Sample.Alternates,
+			want: map[string][]string{
+				"original": {base + "01/23/0123456789abcdef0123456789abcdef.webm", base + "sample/01/23/0123456789abcdef0123456789abcdef.mp4"},
+				"480p":     {base + "sample/01/23/0123456789abcdef0123456789abcdef_480p.mp4"},
+			},
+		},
+		{
+			name:       "empty",
+			alternates: posts.Posts[1].Sample.Alternates,
+			want:       map[string][]string{},
+		},
+		{
+			name:       "old shape",
+			alternates: decodeAlternates(t, `{"720p": {"type": "video", "width": 1280, "height": 720, "urls": ["a.webm", null]}, "has": true}`),
+			want:       map[string][]string{"720p": {"a.webm", ""}},
+		},
+		{
+			name:       "broken entries",
+			alternates: decodeAlternates(t, `{"original": 5, "variants": [], "samples": {"480p": {"url": null}, "720p": {"url": "b.mp4"}}}`),
+			want:       map[string][]string{"720p": {"b.mp4"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.alternates) != len(tt.want) {
+				t.Errorf("Expected %d alternates, got %v", len(tt.want), tt.alternates)
+			}
+			for name, urls := range tt.want {
+				if got := tt.alternates[name].URLs; !slices.Equal(got, urls) {
+					t.Errorf("Expected %v to have %v, got %v", name, urls, got)
+				}
+			}
+		})
+	}
+}
+
+func decodeAlternates(t *testing.T, data string) Alternates {
+	t.Helper()
+	var a Alternates
+	if err := json.Unmarshal([]byte(data), &a); err != nil {
+		t.Fatalf("Failed to decode alternates: %v", err)
+	}
+	return a
+}
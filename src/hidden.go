@@ -0,0 +1,59 @@
+package main
+
+// Upstream hides file urls (null) of deleted posts, and of posts on the global blacklist for anonymous users.
+// The files are still where e621 always puts them, so the urls can be rebuilt from the md5.
+
+type hiddenFilesPolicy string
+
+const (
+	hiddenFilesOff      hiddenFilesPolicy = "off"      // leave them hidden
+	hiddenFilesArchived hiddenFilesPolicy = "archived" // link them, but only serve them if the file is in storage already
+	hiddenFilesAll      hiddenFilesPolicy = "all"      // link them, and download them from STATIC_BASE if needed
+)
+
+var (
+	staticBase = "https://static1.e621.net" // where upstream keeps its files, set with STATIC_BASE
+
+	// set with HIDDEN_FILES
+	hiddenFiles = hiddenFilesOff
+	// users that get links to hidden files, set with HIDDEN_FILES_USERS. Empty means everyone, including anonymous users
+	hiddenFilesUsers = map[string]bool{}
+)
+
+// staticURL rebuilds the url of a variant of a post from its md5, the way e621 lays out its files, or returns "" if it can't.
+func staticURL(post *Post, variant linkVariant) string {
+	md5 := post.File.MD5
+	if !md5Regex.MatchString(md5) || !alternateRegex.MatchString(post.File.Ext) {
+		return ""
+	}
+	dir := md5[0:2] + "/" + md5[2:4] + "/"
+
+	switch variant {
+	case variantOriginal:
+		return staticBase + "/data/" + dir + md5 + "." + post.File.Ext
+	case variantSample:
+		// small posts have no sample, their sample url is the original
+		if !post.Sample.Has {
+			return staticBase + "/data/" + dir + md5 + "." + post.File.Ext
+		}
+		return staticBase + "/data/sample/" + dir + md5 + ".jpg"
+	case variantPreview:
+		return staticBase + "/data/preview/" + dir + md5 + ".jpg"
+	}
+	return ""
+}
+
+// hiddenFileURL returns the rebuilt url of a variant upstream didn't give us, or "" if HIDDEN_FILES doesn't allow it.
+// With HIDDEN_FILES=archived, it doesn't check if the file is in storage, which would be a request per link.
+// mediaFile only serves those from storage instead.
+func hiddenFileURL(post *Post, variant linkVariant) string {
+	if hiddenFiles == hiddenFilesOff {
+		return ""
+	}
+	return staticURL(post, variant)
+}
+
+// canSeeHiddenFiles reports whether user gets links to hidden files.
+func canSeeHiddenFiles(user string) bool {
+	return hiddenFiles != hiddenFilesOff && (len(hiddenFilesUsers) == 0 || hiddenFilesUsers[user])
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func setHiddenFiles(t *testing.T, policy hiddenFilesPolicy, users ...string) {
+	t.Helper()
+	oldPolicy, oldUsers, oldBase := hiddenFiles, hiddenFilesUsers, staticBase
+	t.Cleanup(func() { hiddenFiles, hiddenFilesUsers, staticBase = oldPolicy, oldUsers, oldBase })
+
+	hiddenFiles = policy
+	hiddenFilesUsers = map[string]bool{}
+	for _, u := range users {
+		hiddenFilesUsers[u] = true
+	}
+}
+
+func TestStaticURL(t *testing.T) {
+	md5 := "0123456789abcdef0123456789abcdef"
+	base := "https://static1.e621.net/data/"
+
+	for _, tt := range []struct {
+		name    string
+		file    File
+		sample  bool
+		variant linkVariant
+		want    string
+	}{
+		{"original", File{MD5: md5, Ext: "webm"}, true, variantOriginal, base + "01/23/" + md5 + ".webm"},
+		{"sample", File{MD5: md5, Ext: "png"}, true, variantSample, base + "sample/01/23/" + md5 + ".jpg"},
+		{"no sample", File{MD5: md5, Ext: "png"}, false, variantSample, base + "01/23/" + md5 + ".png"},
+		{"preview", File{MD5: md5, Ext: "gif"}, false, variantPreview, base + "preview/01/23/" + md5 + ".jpg"},
+		{"alternate", File{MD5: md5, Ext: "webm"}, true, variantAlternate, ""},
+		{"no md5", File{Ext: "png"}, true, variantOriginal, ""},
+		{"invalid md5", File{MD5: "../../etc/passwd", Ext: "png"}, true, variantOriginal, ""},
+		{"invalid ext", File{MD5: md5, Ext: "png/../x"}, true, variantOriginal, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			post := &Post{File: tt.file, Sample: Sample{Has: tt.sample}}
+			if got := staticURL(post, tt.variant); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHiddenFilesPolicy(t *testing.T) {
+	post := &Post{File: File{MD5: "fedcba9876543210fedcba9876543210", Ext: "png"}}
+
+	for _, tt := range []struct {
+		policy hiddenFilesPolicy
+		users  []string
+		user   string
+		link   bool
+	}{
+		{hiddenFilesOff, nil, "", false},
+		{hiddenFilesOff, nil, "alice", false},
+		{hiddenFilesArchived, nil, "", true},
+		{hiddenFilesAll, nil, "", true},
+		{hiddenFilesAll, []string{"alice"}, "alice", true},
+		{hiddenFilesAll, []string{"alice"}, "bob", false},
+		{hiddenFilesAll, []string{"alice"}, "", false},
+	} {
+		setHiddenFiles(t, tt.policy, tt.users...)
+		setupLinks(t)
+		if got := makeProxyLink(post, variantOriginal, tt.user) != ""; got != tt.link {
+			t.Errorf("HIDDEN_FILES=%v, users %v, user %q: expected a link %v, got %v", tt.policy, tt.users, tt.user, tt.link, got)
+		}
+	}
+}
+
+// Null urls, and posts without md5, never get a link or crash, whatever the policy.
+func TestHiddenFilesNullURLs(t *testing.T) {
+	for _, policy := range []hiddenFilesPolicy{hiddenFilesOff, hiddenFilesArchived, hiddenFilesAll} {
+		setHiddenFiles(t, policy)
+		setupLinks(t)
+
+		empty := &Post{}
+		for _, variant := range []linkVariant{variantOriginal, variantSample, variantPreview, variantAlternate} {
+			if link := makeProxyLink(empty, variant, ""); link != "" {
+				t.Errorf("HIDDEN_FILES=%v: expected no %v link without md5, got %v", policy, variant, link)
+			}
+		}
+		if downloads := variantDownloads(empty, variantOriginal, variantSample, variantPreview); len(downloads) != 0 {
+			t.Errorf("HIDDEN_FILES=%v: expected no downloads without md5, got %v", policy, downloads)
+		}
+		rewritePostURLs(empty, "")
+	}
+}
+
+func TestMediaFileHidden(t *testing.T) {
+	d := openTestDB(t)
+	setupMediaStorage(t)
+	setupLinks(t)
+	ctx := context.Background()
+
+	// hidden files must never be downloaded with HIDDEN_FILES=archived
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected upstream request for %v", r.URL)
+		http.Error(w, "no", http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	_, posts := loadTestPosts(t)
+	post := &posts.Posts[1] // deleted, every url is null
+	if err := d.UpsertPosts(ctx, []*Post{post}); err != nil {
+		t.Fatalf("UpsertPosts failed: %v", err)
+	}
+
+	router := gin.New()
+	router.GET("/media/:md5", mediaFile)
+	router.GET("/media/:md5/:variant", mediaFile)
+	get := func(link, user string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, strings.TrimPrefix(link, PROXY_URL), nil)
+		if user != "" {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":key")))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	setHiddenFiles(t, hiddenFilesArchived, "alice")
+	staticBase = upstream.URL
+	link := makeProxyLink(post, variantOriginal, "alice")
+	if link == "" {
+		t.Fatal("Expected a link for alice")
+	}
+
+	if code := get(link, "alice"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 while the file isn't in storage, got %d", code)
+	}
+
+	key, _ := objectKey(staticURL(post, variantOriginal))
+	if err := MediaStorage.Put(ctx, strings.NewReader("png"), key); err != nil {
+		t.Fatalf("Failed to store the file: %v", err)
+	}
+	if code := get(link, "alice"); code != http.StatusOK {
+		t.Errorf("Expected 200 from storage, got %d", code)
+	}
+
+	// links aren't bound to alice, so they have to be checked again
+	if code := get(link, ""); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for anonymous users, got %d", code)
+	}
+	if code := get(link, "bob"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for bob, got %d", code)
+	}
+	hiddenFiles = hiddenFilesOff
+	if code := get(link, "alice"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 once HIDDEN_FILES is off, got %d", code)
+	}
+}
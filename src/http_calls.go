@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bugmaschine/e6-cache/dualreader"
+	"bugmaschine/e6-cache/jsonrewrite"
 	"bugmaschine/e6-cache/logging"
 	"bytes"
 	"compress/flate"
@@ -13,8 +13,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"path/filepath"
-	"regexp"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -31,39 +30,18 @@ var (
 	}
 )
 
-func makeProxyLink(original string) string {
-	if original == "" { // in case the input is empty, just return an empty string
-		logging.Warn("Received empty URL for proxying")
-		return ""
-	}
-	// basically get the part after "data/" in the url
-	re := regexp.MustCompile(`data/(.+)`)
-	match := re.FindStringSubmatch(original)
-
-	sig := Signer.Sign(original)
-
-	// We sign the url so a malicious attacker can't just change the url to download any file. But this also means that the signature changes every restart.
-	encodedUrl := base64.URLEncoding.EncodeToString([]byte(original))
-
-	// if the route changes, we need to update this
-	proxiedURL := PROXY_URL + "/proxy/" + encodedUrl + "?sig=" + sig
-	logging.Info("Creating proxy url for file: %v | ID: %v | Proxied URL: %v", original, match[1], proxiedURL)
-
-	return proxiedURL
-}
-
-func proxyAndTransform(c *gin.Context) {
-
-	logging.Debug("Headers: %v", c.Request.Header)
+// key of the authenticated username in the gin context
+const proxyUserKey = "proxyUser"
 
+// authenticate checks the proxy auth (if enabled) and returns the username of the request, or "" for anonymous requests.
+// With proxy auth, the Authorization header gets rewritten to what upstream expects.
+func authenticate(c *gin.Context) (string, bool) {
 	auth := c.Request.Header.Get("Authorization")
 
-	requestUsername := ""
 	// if proxy auth is enabled, check for auth header
 	if PROXY_AUTH != "" {
 		if auth == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
+			return "", false
 		}
 
 		// an auth header should normaly look like this: base64 hashed username:password
@@ -73,31 +51,50 @@ func proxyAndTransform(c *gin.Context) {
 		decodedAuth, err := base64.StdEncoding.DecodeString(auth)
 		if err != nil {
 			logging.Error("Error decoding auth header: %v", err)
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
+			return "", false
 		}
 		// parse it into username, password and proxy auth
 		authParts := strings.Split(string(decodedAuth), ":")
-		suppliedProxyAuth := authParts[1] // to change the password position you need to change this here. 1 is after the username, 2 is after the proxy auth
 		logging.Debug("Parsed Proxy Authorization header: %v", authParts)
-		if len(authParts) != 3 || suppliedProxyAuth != PROXY_AUTH {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
+		if len(authParts) != 3 || authParts[1] != PROXY_AUTH { // to change the password position you need to change this here. 1 is after the username, 2 is after the proxy auth
+			return "", false
 		}
 
 		c.Request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(authParts[0]+":"+authParts[2])))
-	} else {
-		// this gets run if the proxy auth function not enabled
-		if auth == "" {
-			logging.Debug("No Authorization header found, using anonymous user")
-			requestUsername = "anonymous"
-		}
+		return authParts[0], true
+	}
 
-		// parse the Authorization header
-		auth = strings.ReplaceAll(auth, "Basic ", "")
-		decodedAuth, _ := base64.URLEncoding.DecodeString(auth)
-		splitAuth := strings.Split(string(decodedAuth), ":")
-		requestUsername = splitAuth[0] // 0 is username, 1 is api key
+	// this gets run if the proxy auth function not enabled
+	if auth == "" {
+		logging.Debug("No Authorization header found, using anonymous user")
+		return "", true
+	}
+
+	// parse the Authorization header
+	auth = strings.TrimPrefix(auth, "Basic ")
+	decodedAuth, _ := base64.StdEncoding.DecodeString(auth)
+	splitAuth := strings.Split(string(decodedAuth), ":")
+	return splitAuth[0], true // 0 is username, 1 is api key
+}
+
+func proxyAndTransform(c *gin.Context) {
+
+	logging.Debug("Headers: %v", c.Request.Header)
+
+	requestUsername, ok := authenticate(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.Set(proxyUserKey, requestUsername)
+
+	if offlineMode == offlineOnly {
+		if !canServeOffline(c) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Not available in offline mode", "ok": false})
+			return
+		}
+		serveOffline(c)
+		return
 	}
 
 	// Construct full target URL
@@ -132,11 +129,32 @@ func proxyAndTransform(c *gin.Context) {
 	// Perform request
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
+		if offlineMode == offlineFallback && canServeOffline(c) {
+			logging.Warn("Failed to reach backend, falling back to the archive: %v", err)
+			serveOffline(c)
+			return
+		}
 		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Failed to reach backend"})
 		return
 	}
 	defer resp.Body.Close()
 
+	if isUpstreamDown(resp.StatusCode) && offlineMode == offlineFallback && canServeOffline(c) {
+		logging.Warn("Backend returned %v, falling back to the archive", resp.StatusCode)
+		serveOffline(c)
+		return
+	}
+
+	// posts that are gone upstream are still in the archive
+	if resp.StatusCode == http.StatusNotFound && c.Request.Method == http.MethodGet {
+		if match := offlinePostRegex.FindStringSubmatch(c.Request.URL.Path); match != nil {
+			id, _ := strconv.ParseInt(match[1], 10, 64)
+			if serveVanishedPost(c, id) {
+				return
+			}
+		}
+	}
+
 	var reader io.ReadCloser
 
 	// https://stackoverflow.com/questions/13130341/reading-gzipped-http-response-in-go
@@ -194,6 +212,12 @@ func proxyAndTransform(c *gin.Context) {
 
 	logging.Debug("Response Body: %v", string(respBody))
 
+	// stored with the raw json of everything we save
+	fetchedAt := time.Now()
+	sourceURL := archiveSourceURL(originalURL)
+	authenticated := req.Header.Get("Authorization") != "" || c.Query("api_key") != ""
+
+	// the structs are only for the database, the client gets upstream's response as it is, apart from the media urls
 	switch {
 	case strings.HasSuffix(c.Request.URL.Path, "/comments.json") && c.Query("search[post_id]") != "": // specific post comments are returned differently
 		var comments []Comment
@@ -206,13 +230,14 @@ func proxyAndTransform(c *gin.Context) {
 				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid response format", "ok": false})
 				return
 			}
-			respBody, _ = json.Marshal(comments)
-			return
+			break
 		}
 
+		for i := range comments {
+			comments[i].setFetched(fetchedAt, sourceURL)
+		}
 		logging.Info("Saving %v comments", len(comments))
 		Database.SaveComments(comments)
-		respBody, _ = json.Marshal(comments)
 	case strings.HasSuffix(c.Request.URL.Path, "/posts.json") || strings.HasSuffix(c.Request.URL.Path, "/comments.json"): // comments and posts seem to be the same thing
 		var posts PostsResponse
 
@@ -222,11 +247,23 @@ func proxyAndTransform(c *gin.Context) {
 			return
 		}
 
+		page := make([]*Post, len(posts.Posts))
 		for i := range posts.Posts {
-			ProcessPost(c, &posts.Posts[i])
+			page[i] = &posts.Posts[i]
+			page[i].setFetched(fetchedAt, sourceURL)
+			page[i].Authenticated = authenticated
+		}
+		respBody, err = ProcessPosts(c, respBody, page, func(path jsonrewrite.Path) (*Post, jsonrewrite.Path) {
+			// posts[i]...
+			if i, ok := path.Index(1); ok && path[0] == "posts" && i < len(page) {
+				return page[i], path[2:]
+			}
+			return nil, nil
+		})
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid response format", "ok": false})
+			return
 		}
-
-		respBody, _ = json.Marshal(posts)
 	case strings.HasPrefix(c.Request.URL.Path, "/posts/"):
 		var post PostResponse
 
@@ -237,9 +274,19 @@ func proxyAndTransform(c *gin.Context) {
 			return
 		}
 
-		ProcessPost(c, &post.Post)
-
-		respBody, _ = json.Marshal(post)
+		post.Post.setFetched(fetchedAt, sourceURL)
+		post.Post.Authenticated = authenticated
+		respBody, err = ProcessPosts(c, respBody, []*Post{&post.Post}, func(path jsonrewrite.Path) (*Post, jsonrewrite.Path) {
+			// post...
+			if len(path) > 0 && path[0] == "post" {
+				return &post.Post, path[1:]
+			}
+			return nil, nil
+		})
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid response format", "ok": false})
+			return
+		}
 	case strings.HasSuffix(c.Request.URL.Path, "/pools.json"):
 		var pools []Pool
 
@@ -249,13 +296,12 @@ func proxyAndTransform(c *gin.Context) {
 		}
 
 		for _, pool := range pools {
+			pool.setFetched(fetchedAt, sourceURL)
 			// Store in DB
 			ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
 			defer cancel()
 			Database.UpdatePool(ctx, &pool)
 		}
-
-		respBody, _ = json.Marshal(pools)
 	case strings.Contains(c.Request.URL.Path, "/pools/"):
 		var pool Pool
 
@@ -265,136 +311,28 @@ func proxyAndTransform(c *gin.Context) {
 		}
 
 		// Store in DB
+		pool.setFetched(fetchedAt, sourceURL)
 		ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
 		defer cancel()
 		Database.UpdatePool(ctx, &pool)
-
-		respBody, _ = json.Marshal(pool)
 	}
 
 	// Send client response
 	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), respBody)
 }
 
-func proxyFile(c *gin.Context) {
-	fileID := c.Param("fileId")
-	sig := c.Query("sig")
-
-	if sig == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Missing signature", "ok": false})
-		return
-	}
-
-	url, err := base64.URLEncoding.DecodeString(fileID)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID", "ok": false})
-		return
-	}
-
-	if !Signer.Verify(string(url), sig) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid signature", "ok": false})
-		return
-	}
-
-	// get the filename from the fileID
-	re := regexp.MustCompile(`/data/(.*)`)
-	matches := re.FindStringSubmatch(string(url))
-
-	CleanFileID := matches[1]
-
-	fileExists, err := S3.DoesFileExistInS3(c, string(CleanFileID))
-	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(maxCacheAge.Seconds())))
-	c.Header("Expires", time.Now().Add(time.Duration(maxCacheAge)*time.Second).Format(http.TimeFormat))
-
-	if fileExists && err == nil {
-		logging.Info("File exists in S3, downloading: %v", string(url))
-
-		body, err := S3.StreamFromS3(c, string(CleanFileID))
-		if err != nil {
-			logging.Error("Error downloading from S3: %v", err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to download from S3", "ok": false})
-			return
-		}
-
-		// dont know if streaming from s3 is actually possible, but let's pretend it is
-		contentLength, _ := S3.GetContentLength(c, string(CleanFileID))
-		if body == nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to download from S3", "ok": false})
-			return
-		}
-
-		var contentType string
-		switch ext := filepath.Ext(string(CleanFileID)); ext {
-		// Images
-		case ".jpg", ".jpeg":
-			contentType = "image/jpeg"
-		case ".png":
-			contentType = "image/png"
-		case ".gif":
-			contentType = "image/gif"
-		case ".webp":
-			contentType = "image/webp"
-		case ".bmp":
-			contentType = "image/bmp"
-		case ".tiff", ".tif":
-			contentType = "image/tiff"
-
-		// Videos
-		case ".webm":
-			contentType = "video/webm"
-		case ".mp4":
-			contentType = "video/mp4"
-		case ".mov":
-			contentType = "video/quicktime"
-		case ".avi":
-			contentType = "video/x-msvideo"
-		case ".mkv":
-			contentType = "video/x-matroska"
-		case ".flv":
-			contentType = "video/x-flv"
-		case ".ogv":
-			contentType = "video/ogg"
-
-		default:
-			contentType = "application/octet-stream"
-		}
-
-		c.DataFromReader(200, contentLength, contentType, body, nil)
-		return
-	}
-
-	// below only gets called when file does not exist in S3
-	logging.Debug("File not found in S3. Requesting it.")
-
-	// download the image from the api
-	req, _ := http.NewRequest("GET", string(url), nil)
-
-	// i dont think the username is required for downloading files
-	setUseragent("", req)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// archiveSourceURL is the upstream url without credentials, which e621 also accepts as query params.
+func archiveSourceURL(upstreamURL string) string {
+	u, err := url.Parse(upstreamURL)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to proxy request", "ok": false})
-		return
+		return ""
 	}
-	defer resp.Body.Close()
-
-	// some magic to handle streaming the response body to S3 and to the user at the same time
-	dual := dualreader.NewDualReader(resp.Body)
-	r1, r2 := dual.Readers()
-
-	// upload to S3 in the background, while the user is downloading the file
-	go func() {
-		logging.Info("Uploading to S3: %v", string(CleanFileID))
-		err := S3.UploadToS3(c, r1, string(CleanFileID))
-		if err != nil {
-			logging.Error("Failed to upload to S3: %v", err)
-		}
-		logging.Info("Upload to S3 complete: %v", string(CleanFileID))
-	}()
-
-	// Stream live to user (I hope it's actually streaming)
-	c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), r2, nil)
+	query := u.Query()
+	query.Del("login")
+	query.Del("api_key")
+	u.RawQuery = query.Encode()
+	u.User = nil
+	return u.String()
 }
 
 func copyHeaders(src http.Header, dst http.Header) {
@@ -417,15 +355,80 @@ func copyHeaders(src http.Header, dst http.Header) {
 	}
 }
 
-func ProcessPost(c *gin.Context, post *Post) {
-	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
-	defer cancel()
-	Database.CheckAndInsertPost(ctx, post)
+// ProcessPosts saves a page of posts (as upstream sent them) and returns body with their media urls going through the proxy.
+// postAt finds the post a value in body belongs to, and where in the post the value is.
+func ProcessPosts(c *gin.Context, body []byte, posts []*Post, postAt func(path jsonrewrite.Path) (*Post, jsonrewrite.Path)) ([]byte, error) {
+	savePosts(posts)
+	ingestEagerAlternates(posts)
+	prefetchMedia(posts)
+
+	return rewritePosts(body, c.GetString(proxyUserKey), postAt)
+}
 
-	// Rewrite url to go through the proxy
-	post.File.URL = makeProxyLink(post.File.URL)
-	post.Preview.URL = makeProxyLink(post.Preview.URL)
-	post.Sample.URL = makeProxyLink(post.Sample.URL)
+// rewritePosts makes the media urls of the posts in body go through the proxy, leaving the rest of it as it is.
+// postAt returns the post a json path belongs to and the path within it.
+func rewritePosts(body []byte, user string, postAt func(path jsonrewrite.Path) (*Post, jsonrewrite.Path)) ([]byte, error) {
+	return jsonrewrite.Rewrite(body, func(path jsonrewrite.Path, value *string) (string, bool) {
+		post, field := postAt(path)
+		if post == nil {
+			return "", false
+		}
+
+		if name, ok := alternateName(field); ok {
+			if value == nil {
+				return "", false
+			}
+			link := makeAlternateLink(post, name, *value, user)
+			return link, link != ""
+		}
+
+		var variant linkVariant
+		switch {
+		case field.Match("file", "url"):
+			variant = variantOriginal
+		case field.Match("sample", "url"):
+			variant = variantSample
+		case field.Match("preview", "url"):
+			variant = variantPreview
+		default:
+			return "", false
+		}
+
+		// no link means upstream didn't give us a url either, so leave it as it was
+		link := makeProxyLink(post, variant, user)
+		return link, link != ""
+	})
+}
+
+// alternateName returns the name of the alternate a url in sample.alternates belongs to, see Alternates.UnmarshalJSON.
+func alternateName(field jsonrewrite.Path) (string, bool) {
+	switch {
+	case field.Match("sample", "alternates", "*", "urls", "*"): // the old shape, {name}.urls.{i}
+		return field[2], true
+	case field.Match("sample", "alternates", "original", "url"), field.Match("sample", "alternates", "variants", "*", "url"):
+		return "original", true
+	case field.Match("sample", "alternates", "samples", "*", "url"):
+		return field[3], true
+	}
+	return "", false
+}
+
+// rewritePostURLs makes all file urls of a post go through the proxy, for responses we build ourselves.
+// user is who the links get bound to, if LINK_BIND_USER is enabled.
+func rewritePostURLs(post *Post, user string) {
+	fileURL := makeProxyLink(post, variantOriginal, user)
+	previewURL := makeProxyLink(post, variantPreview, user)
+	sampleURL := makeProxyLink(post, variantSample, user)
+
+	post.File.URL = fileURL
+	post.Preview.URL = previewURL
+	post.Sample.URL = sampleURL
+
+	for name, alternate := range post.Sample.Alternates {
+		for i, u := range alternate.URLs {
+			alternate.URLs[i] = makeAlternateLink(post, name, u, user)
+		}
+	}
 }
 
 func setUseragent(username string, req *http.Request) {
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/jsonrewrite"
+	"bugmaschine/e6-cache/signer"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func setupLinks(t *testing.T) {
+	t.Helper()
+	Signer = signer.NewSigner(signer.GenerateSecretKey())
+	PROXY_URL = "http://proxy"
+	gin.SetMode(gin.TestMode)
+}
+
+func TestProcessPosts(t *testing.T) {
+	d := openTestDB(t)
+	setupLinks(t)
+	body, posts := loadTestPosts(t)
+
+	page := make([]*Post, len(posts.Posts))
+	for i := range posts.Posts {
+		page[i] = &posts.Posts[i]
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	out, err := ProcessPosts(c, body, page, func(path jsonrewrite.Path) (*Post, jsonrewrite.Path) {
+		if i, ok := path.Index(1); ok && path[0] == "posts" && i < len(page) {
+			return page[i], path[2:]
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("ProcessPosts failed: %v", err)
+	}
+
+	rewritten := string(out)
+	start, end := strings.Index(rewritten, `"alternates"`), strings.Index(rewritten, `"score"`)
+	if alternates := rewritten[start:end]; strings.Contains(alternates, "static1.e621.net") {
+		t.Errorf("Expected every alternate to go through the proxy, got %v", alternates)
+	}
+	for _, link := range []string{
+		"http://proxy/media/0123456789abcdef0123456789abcdef.webm?",
+		"http://proxy/media/0123456789abcdef0123456789abcdef/original.webm?",
+		"http://proxy/media/0123456789abcdef0123456789abcdef/original.mp4?",
+		"http://proxy/media/0123456789abcdef0123456789abcdef/480p.mp4?",
+	} {
+		if !strings.Contains(rewritten, link) {
+			t.Errorf("Expected a link to %v", link)
+		}
+	}
+	// no url upstream and HIDDEN_FILES off, so it stays null
+	if !strings.Contains(rewritten, `"file":{"width":800,"height":600,"ext":"png","size":123456,"md5":"fedcba9876543210fedcba9876543210","url":null}`) {
+		t.Errorf("Expected the hidden file url to stay null")
+	}
+
+	stored, err := d.GetPost(context.Background(), 5012345)
+	if err != nil {
+		t.Fatalf("GetPost failed: %v", err)
+	}
+	if u, ok := alternateURL(stored, "480p", "mp4"); !ok || !strings.HasSuffix(u, "_480p.mp4") {
+		t.Errorf("Expected the stored post to have the 480p alternate, got %v", stored.Sample.Alternates)
+	}
+}
@@ -0,0 +1,126 @@
+// Package httprange handles the Range and conditional request headers (RFC 9110) for files that aren't io.ReadSeekers,
+// which rules out http.ServeContent.
+package httprange
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnsatisfiable means the range is valid, but outside of the file. The response should be 416.
+var ErrUnsatisfiable = errors.New("range not satisfiable")
+
+// Range is an inclusive byte range.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+func (r Range) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+// ContentRange is the value of the Content-Range header for this range.
+func (r Range) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// Parse parses a Range header for a file of the given size.
+// Only single ranges are supported, for anything else ok is false and the whole file should be sent.
+func Parse(header string, size int64) (r Range, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return Range{}, false, nil
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return Range{}, false, nil
+	}
+
+	if first == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return Range{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return Range{}, false, ErrUnsatisfiable
+		}
+		return Range{Start: max(size-n, 0), End: size - 1}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return Range{}, false, nil
+	}
+	if start >= size {
+		return Range{}, false, ErrUnsatisfiable
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return Range{}, false, nil
+		}
+		end = min(end, size-1)
+	}
+
+	return Range{Start: start, End: end}, true, nil
+}
+
+// IsWholeFile reports if the header asks for everything from the first byte on ("bytes=0-"), which is what most video players start with.
+func IsWholeFile(header string) bool {
+	return strings.TrimSpace(header) == "bytes=0-"
+}
+
+// NotModified reports if the conditional headers of the request allow a 304 response.
+func NotModified(h http.Header, etag string, lastModified time.Time) bool {
+	if inm := h.Get("If-None-Match"); inm != "" {
+		// If-None-Match wins over If-Modified-Since
+		return etag != "" && etagListContains(inm, etag)
+	}
+
+	if ims := h.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+
+	return false
+}
+
+// IfRange reports if the Range header should be honored, according to If-Range.
+func IfRange(h http.Header, etag string, lastModified time.Time) bool {
+	ir := h.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		// If-Range needs a strong comparison
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ir == etag
+	}
+
+	t, err := http.ParseTime(ir)
+	return err == nil && !lastModified.IsZero() && lastModified.Truncate(time.Second).Equal(t)
+}
+
+// etagListContains does the weak comparison If-None-Match uses
+func etagListContains(list, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package httprange
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	const size = 1000
+
+	tests := []struct {
+		header string
+		want   Range
+		ok     bool
+		err    error
+	}{
+		{"bytes=0-99", Range{0, 99}, true, nil},
+		{"bytes=100-", Range{100, 999}, true, nil},
+		{"bytes=-100", Range{900, 999}, true, nil},
+		{"bytes=-5000", Range{0, 999}, true, nil},
+		{"bytes=900-5000", Range{900, 999}, true, nil},
+		{"bytes=0-0", Range{0, 0}, true, nil},
+		{"bytes=1000-", Range{}, false, ErrUnsatisfiable},
+		{"bytes=-0", Range{}, false, ErrUnsatisfiable},
+		{"bytes=0-10,20-30", Range{}, false, nil}, // multiple ranges get ignored
+		{"bytes=10-5", Range{}, false, nil},
+		{"bytes=abc-", Range{}, false, nil},
+		{"items=0-10", Range{}, false, nil},
+		{"", Range{}, false, nil},
+	}
+
+	for _, tt := range tests {
+		got, ok, err := Parse(tt.header, size)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Parse(%q) error = %v, expected %v", tt.header, err, tt.err)
+		}
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("Parse(%q) = %+v, %v, expected %+v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	r := Range{Start: 100, End: 199}
+	if r.Length() != 100 {
+		t.Errorf("Expected length 100, got %d", r.Length())
+	}
+	if got := r.ContentRange(1000); got != "bytes 100-199/1000" {
+		t.Errorf("Unexpected Content-Range: %v", got)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2025, 5, 1, 12, 0, 0, 500, time.UTC)
+	etag := `"abc"`
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no headers", nil, false},
+		{"matching etag", map[string]string{"If-None-Match": `"abc"`}, true},
+		{"etag in list", map[string]string{"If-None-Match": `"x", W/"abc"`}, true},
+		{"wildcard", map[string]string{"If-None-Match": `*`}, true},
+		{"other etag", map[string]string{"If-None-Match": `"xyz"`}, false},
+		{"etag wins over date", map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": lastModified.Add(time.Hour).Format(http.TimeFormat)}, false},
+		{"not modified since", map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, true},
+		{"modified since", map[string]string{"If-Modified-Since": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, false},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, false},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		if got := NotModified(h, etag, lastModified); got != tt.want {
+			t.Errorf("%v: NotModified = %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	lastModified := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	etag := `"abc"`
+
+	tests := []struct {
+		ifRange string
+		want    bool
+	}{
+		{"", true},
+		{`"abc"`, true},
+		{`"xyz"`, false},
+		{`W/"abc"`, false}, // weak etags never match If-Range
+		{lastModified.Format(http.TimeFormat), true},
+		{lastModified.Add(-time.Hour).Format(http.TimeFormat), false},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.ifRange != "" {
+			h.Set("If-Range", tt.ifRange)
+		}
+		if got := IfRange(h, etag, lastModified); got != tt.want {
+			t.Errorf("IfRange(%q) = %v, expected %v", tt.ifRange, got, tt.want)
+		}
+	}
+}
+
+func TestIsWholeFile(t *testing.T) {
+	if !IsWholeFile("bytes=0-") {
+		t.Errorf("bytes=0- should be the whole file")
+	}
+	if IsWholeFile("bytes=0-1") || IsWholeFile("bytes=100-") {
+		t.Errorf("Partial ranges should not be the whole file")
+	}
+}
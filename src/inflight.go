@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/dualreader"
+	"bugmaschine/e6-cache/logging"
+	"bugmaschine/e6-cache/storage"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// flightGroup makes concurrent calls with the same key share one execution, like x/sync/singleflight.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+type flightCall[T any] struct {
+	wg  sync.WaitGroup
+	val T
+	err error
+}
+
+func (g *flightGroup[T]) Do(key string, fn func() (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall[T]{}
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+
+	call := &flightCall[T]{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.val, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return call.val, call.err
+}
+
+type statResult struct {
+	info   storage.ObjectInfo
+	exists bool
+}
+
+var statFlights flightGroup[statResult]
+
+// statShared is MediaStorage.Stat, but concurrent calls for the same key only send one request.
+// It doesn't use the context of the caller, so one client going away doesn't fail the others.
+func statShared(key string) (storage.ObjectInfo, bool, error) {
+	result, err := statFlights.Do(key, func() (statResult, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+		defer cancel()
+
+		info, exists, err := MediaStorage.Stat(ctx, key)
+		return statResult{info: info, exists: exists}, err
+	})
+	return result.info, result.exists, err
+}
+
+// mediaFlight is an upstream download of a file, which every client asking for the same file reads from.
+type mediaFlight struct {
+	ready chan struct{} // closed once the response headers are in, or the request failed
+	done  chan struct{} // closed once the file is saved, or that failed
+
+	// only valid after ready is closed
+	err           error
+	tee           *dualreader.Tee
+	status        int
+	contentLength int64
+	contentType   string
+
+	// only valid after done is closed, nil once the file is in storage
+	saveErr error
+
+	// guarded by mediaFlightsMu. The flight keeps the tee open until every client that joined took its reader
+	readers  int
+	finished bool
+}
+
+var (
+	spoolDir     = "" // where downloads get spooled while they are streamed, set with SPOOL_DIR. Defaults to the system temp dir
+	maxSpoolSize = int64(2 << 30)
+
+	mediaFlightsMu sync.Mutex
+	mediaFlights   = map[string]*mediaFlight{}
+)
+
+// joinMediaFlight returns the running download of key, or starts one.
+// The download gets saved to storage under key, and the flight ends once that's done.
+// With read set, the caller has to call reader once, and the download stays readable until then.
+func joinMediaFlight(key, upstreamURL string, read bool) *mediaFlight {
+	mediaFlightsMu.Lock()
+	defer mediaFlightsMu.Unlock()
+
+	if flight, ok := mediaFlights[key]; ok {
+		logging.Debug("Joining running download of %v", key)
+		if read {
+			flight.readers++
+		}
+		return flight
+	}
+
+	flight := &mediaFlight{ready: make(chan struct{}), done: make(chan struct{})}
+	if read {
+		flight.readers++
+	}
+	mediaFlights[key] = flight
+
+	ingestions.start(key)
+	go flight.run(key, upstreamURL)
+
+	return flight
+}
+
+// reader waits for the response headers, and returns a reader from the start of the download.
+func (f *mediaFlight) reader() (io.ReadCloser, error) {
+	<-f.ready
+
+	mediaFlightsMu.Lock()
+	defer mediaFlightsMu.Unlock()
+
+	f.readers--
+	defer f.closeTee()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.tee.NewReader()
+}
+
+// closeTee lets go of the tee once the flight is over and every client took its reader, must be called with mediaFlightsMu held.
+func (f *mediaFlight) closeTee() {
+	if f.finished && f.readers == 0 && f.tee != nil {
+		f.tee.Close()
+	}
+}
+
+func (f *mediaFlight) run(key, upstreamURL string) {
+	defer close(f.done)
+	defer ingestions.done(key)
+	defer func() {
+		mediaFlightsMu.Lock()
+		delete(mediaFlights, key)
+		f.finished = true
+		f.closeTee()
+		mediaFlightsMu.Unlock()
+	}()
+
+	// the download is shared and has to finish even if every client goes away, so it can't be tied to the request that started it
+	ctx, cancel := context.WithTimeout(context.Background(), ingestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		f.err = err
+		close(f.ready)
+		return
+	}
+
+	// i dont think the username is required for downloading files
+	setUseragent("", req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		f.err = err
+		close(f.ready)
+		return
+	}
+
+	// spooled to disk, so big videos don't sit in memory and slow clients don't hold back the upload
+	maxSize := maxSpoolSize
+	if resp.ContentLength >= 0 {
+		maxSize = resp.ContentLength
+	}
+	f.tee = dualreader.NewTee(resp.Body, dualreader.TeeOptions{MaxSize: maxSize, TempDir: spoolDir})
+
+	reader, err := f.tee.NewReader()
+	if err != nil {
+		// can't happen, the tee isn't closed yet
+		f.err = err
+		close(f.ready)
+		return
+	}
+	defer reader.Close()
+
+	f.status = resp.StatusCode
+	f.contentLength = resp.ContentLength
+	f.contentType = resp.Header.Get("Content-Type")
+	close(f.ready)
+
+	// error pages must never end up in storage, they would be served as the file forever
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logging.Warn("Upstream answered %v for %v, not saving it", resp.StatusCode, upstreamURL)
+		mediaMisses.add(key, resp.StatusCode)
+		f.saveErr = fmt.Errorf("upstream answered %v", resp.StatusCode)
+		// clients are still reading the error page, canceling ctx would cut it off
+		f.tee.Sums()
+		return
+	}
+
+	// save it in the background, while the clients are downloading the file
+	logging.Info("Saving to storage: %v", key)
+
+	// truncated or corrupted downloads make the upload fail
+	upload := newVerifyingReader(reader, f.tee, resp.ContentLength, expectedMD5(key))
+
+	if err := MediaStorage.Put(ctx, upload, key); err != nil {
+		logging.Error("Failed to save to storage: %v", err)
+		f.saveErr = err
+		return
+	}
+	logging.Info("Saved to storage: %v", key)
+}
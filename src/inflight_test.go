@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/storage"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func setupMediaStorage(t *testing.T) {
+	t.Helper()
+	local, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	MediaStorage = local
+	spoolDir = t.TempDir()
+	mediaMisses = &negativeCache{entries: map[string]negativeEntry{}}
+	gin.SetMode(gin.TestMode)
+}
+
+// getMedia serves key through serveMedia, like a client asking for it.
+func getMedia(key, upstreamURL string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/media/"+key, nil)
+	serveMedia(c, key, upstreamURL)
+	return w
+}
+
+func waitForIngestions(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ingestions.wait(ctx); err != nil {
+		t.Fatalf("Downloads didn't finish: %v", err)
+	}
+}
+
+// The flight is over right after the headers of an error page are in, clients must still get the page instead of a 503.
+func TestServeMediaUpstreamError(t *testing.T) {
+	setupMediaStorage(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	for i := range 50 {
+		key := fmt.Sprintf("sample/missing-%d.jpg", i)
+		w := getMedia(key, upstream.URL+"/"+key)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("Expected 404 for %v, got %d: %v", key, w.Code, w.Body.String())
+		}
+		if body := w.Body.String(); body != "gone\n" {
+			t.Fatalf("Expected the upstream error page, got %q", body)
+		}
+	}
+	waitForIngestions(t)
+
+	// remembered, so upstream isn't asked again
+	if w := getMedia("sample/missing-0.jpg", upstream.URL+"/sample/missing-0.jpg"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 from the negative cache, got %d", w.Code)
+	}
+}
+
+// Small files are saved before the client took its reader, which must not fail it either.
+func TestServeMediaSmallFile(t *testing.T) {
+	setupMediaStorage(t)
+	content := "hello"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content)
+	}))
+	defer upstream.Close()
+
+	// md5 of "hello", so the download gets verified like an original
+	key := "5d/41/5d41402abc4b2a76b9719d911017c592.txt"
+	w := getMedia(key, upstream.URL+"/"+key)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("Expected 200 %q, got %d %q", content, w.Code, w.Body.String())
+	}
+	waitForIngestions(t)
+
+	_, exists, err := MediaStorage.Stat(context.Background(), key)
+	if err != nil || !exists {
+		t.Fatalf("Expected the file in storage, got %v %v", exists, err)
+	}
+}
+
+func TestServeMediaMD5Mismatch(t *testing.T) {
+	setupMediaStorage(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "not hello")
+	}))
+	defer upstream.Close()
+
+	key := "5d/41/5d41402abc4b2a76b9719d911017c592.png"
+	getMedia(key, upstream.URL+"/"+key)
+	waitForIngestions(t)
+
+	_, exists, err := MediaStorage.Stat(context.Background(), key)
+	if err != nil || exists {
+		t.Fatalf("Expected the corrupted file not to be saved, got %v %v", exists, err)
+	}
+}
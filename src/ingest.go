@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ingestTimeout   = 10 * time.Minute // how long a single file download + upload may take, set with INGEST_TIMEOUT
+	shutdownTimeout = 1 * time.Minute  // how long shutdown waits for running ingestions, set with SHUTDOWN_TIMEOUT
+)
+
+// ingestTracker keeps track of running ingestions (download from upstream + saving it to storage), so shutdown can wait for them.
+type ingestTracker struct {
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	active map[string]time.Time // key -> start time
+}
+
+var ingestions = &ingestTracker{active: map[string]time.Time{}}
+
+func (t *ingestTracker) start(key string) {
+	t.wg.Add(1)
+	t.mu.Lock()
+	t.active[key] = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *ingestTracker) done(key string) {
+	t.mu.Lock()
+	delete(t.active, key)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+func (t *ingestTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.active)
+}
+
+// wait blocks until all ingestions are done, or ctx is done.
+func (t *ingestTracker) wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		for key, started := range t.active {
+			logging.Warn("Abandoning ingestion of %v, running since %v", key, started.Format(time.RFC3339))
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// downloadJob is the payload of a jobDownload, it saves upstreamURL to storage under key.
+type downloadJob struct {
+	Key string `json:"key"`
+	URL string `json:"url"`
+}
+
+// downloadJobs turns downloads into jobs, one per object key.
+func downloadJobs(downloads []downloadJob) []Job {
+	newJobs := make([]Job, 0, len(downloads))
+	for _, d := range downloads {
+		job, err := newJob(jobDownload, "download:"+d.Key, jobPriorityDownload, d)
+		if err != nil {
+			logging.Error("Error queueing download of %v: %v", d.Key, err)
+			continue
+		}
+		newJobs = append(newJobs, job)
+	}
+	return newJobs
+}
+
+// queueDownloads submits downloads of files nobody asked for yet, like the alternates in EAGER_ALTERNATES or PREFETCH.
+// They are written to the queue in the background, so responses don't wait for it.
+func queueDownloads(downloads []downloadJob) {
+	if len(downloads) == 0 {
+		return
+	}
+	newJobs := downloadJobs(downloads)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), postWriteTimeout)
+		defer cancel()
+		if err := submitJobs(ctx, newJobs); err != nil {
+			logging.Error("Error queueing %d downloads: %v", len(newJobs), err)
+		}
+	}()
+}
+
+// runDownloadJob downloads a file unless it's in storage already.
+// It joins a download a client started, so a file is never fetched twice at once.
+func runDownloadJob(ctx context.Context, payload json.RawMessage) error {
+	var job downloadJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return fmt.Errorf("%w: %v", errJobPermanent, err)
+	}
+
+	if status, ok := mediaMisses.get(job.Key); ok {
+		return downloadError(status)
+	}
+	if _, exists, err := statShared(job.Key); err != nil {
+		return err
+	} else if exists {
+		return nil
+	}
+
+	logging.Debug("Downloading %v in the background", job.Key)
+	flight := joinMediaFlight(job.Key, job.URL, false)
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if flight.err != nil {
+		return flight.err
+	}
+	if flight.saveErr != nil {
+		if flight.status < 200 || flight.status > 299 {
+			return downloadError(flight.status)
+		}
+		return flight.saveErr
+	}
+	metrics.Add("background_ingests", 1)
+	return nil
+}
+
+// downloadError is the error for an upstream status, files that are gone aren't worth retrying.
+func downloadError(status int) error {
+	switch status {
+	case http.StatusNotFound, http.StatusGone, http.StatusForbidden:
+		return fmt.Errorf("%w: upstream answered %v", errJobPermanent, status)
+	}
+	return fmt.Errorf("upstream answered %v", status)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/dualreader"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	// originals are stored as xx/yy/<md5>.<ext>, so the key tells us what the content has to hash to
+	originalKeyRegex = regexp.MustCompile(`^[0-9a-f]{2}/[0-9a-f]{2}/([0-9a-f]{32})\.[a-z0-9]+$`)
+
+	negativeCacheTTL = 5 * time.Minute // how long failed upstream downloads are remembered, set with NEGATIVE_CACHE_TTL
+
+	errTruncated   = errors.New("download is shorter than Content-Length")
+	errMD5Mismatch = errors.New("download doesn't match the md5 of the post")
+)
+
+// expectedMD5 returns the md5 an object has to have, or "" for previews and samples, which we can't check.
+func expectedMD5(key string) string {
+	if m := originalKeyRegex.FindStringSubmatch(key); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// verifyingReader checks the length and md5 of what passes through it, using the hashes the tee it reads from took.
+// Instead of io.EOF it returns an error if they don't match, which makes saving it fail (S3 aborts the multipart upload, local storage drops the temp file).
+type verifyingReader struct {
+	r        io.Reader
+	tee      *dualreader.Tee
+	length   int64 // expected length, -1 if unknown
+	md5      string
+	finished bool
+}
+
+func newVerifyingReader(r io.Reader, tee *dualreader.Tee, length int64, md5sum string) *verifyingReader {
+	return &verifyingReader{r: r, tee: tee, length: length, md5: md5sum}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+
+	if err == io.EOF && !v.finished {
+		v.finished = true
+		// r is done, so the tee is too
+		sums, sumErr := v.tee.Sums()
+		if sumErr != nil {
+			return n, sumErr
+		}
+		if v.length >= 0 && sums.Size != v.length {
+			return n, fmt.Errorf("%w: got %d of %d bytes", errTruncated, sums.Size, v.length)
+		}
+		if v.md5 != "" && sums.MD5 != v.md5 {
+			return n, fmt.Errorf("%w: expected %v, got %v", errMD5Mismatch, v.md5, sums.MD5)
+		}
+	}
+	return n, err
+}
+
+type negativeEntry struct {
+	status int
+	until  time.Time
+}
+
+// negativeCache remembers upstream downloads that failed, so we don't ask again on every request.
+type negativeCache struct {
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+}
+
+var mediaMisses = &negativeCache{entries: map[string]negativeEntry{}}
+
+func (n *negativeCache) add(key string, status int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.entries[key] = negativeEntry{status: status, until: time.Now().Add(negativeCacheTTL)}
+
+	// drop expired entries every now and then, so this doesn't grow forever
+	if len(n.entries)%100 == 0 {
+		now := time.Now()
+		for k, e := range n.entries {
+			if now.After(e.until) {
+				delete(n.entries, k)
+			}
+		}
+	}
+}
+
+// get returns the status upstream answered with last time, if it's still remembered.
+func (n *negativeCache) get(key string) (int, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	e, ok := n.entries[key]
+	if !ok || time.Now().After(e.until) {
+		return 0, false
+	}
+	return e.status, true
+}
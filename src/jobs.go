@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Background work goes through the jobs table, so it survives restarts and failures get retried.
+// Each kind has a handler, which gets the payload the job was submitted with.
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDead    = "dead" // failed too often, waits for a retry from the admin API
+
+	jobDownload = "download" // a file from upstream into storage, see ingest.go
+	jobRefresh  = "refresh"  // a batch of stale posts, see refresh.go
+	jobArchive  = "archive"  // a page of an archive run, see archive.go
+)
+
+// higher runs first
+const (
+	jobPriorityDownload = 0
+	jobPriorityArchive  = 5
+	jobPriorityRefresh  = 10
+)
+
+var (
+	jobWorkers      = 2                // jobs running at once, 0 leaves the queue to other instances. Set with JOB_WORKERS
+	jobMaxAttempts  = 5                // set with JOB_MAX_ATTEMPTS
+	jobBackoff      = 1 * time.Minute  // wait before the first retry, doubles with every attempt. Set with JOB_BACKOFF
+	maxJobBackoff   = 24 * time.Hour   // longest wait between two attempts
+	jobTimeout      = 15 * time.Minute // how long a job may run before it counts as abandoned
+	jobPollInterval = 5 * time.Second  // how often idle workers look for due jobs
+
+	// started in main
+	jobs *jobQueue
+)
+
+// errJobPermanent fails a job without retries, wrap it with fmt.Errorf("%w: ...").
+var errJobPermanent = errors.New("permanent failure")
+
+type jobHandler func(ctx context.Context, payload json.RawMessage) error
+
+var jobHandlers = map[string]jobHandler{
+	jobDownload: runDownloadJob,
+	jobRefresh:  runRefreshJob,
+	jobArchive:  runArchiveJob,
+}
+
+// newJob builds a job, dedupKey can be empty.
+func newJob(kind, dedupKey string, priority int, payload any) (Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	return Job{Kind: kind, Payload: data, DedupKey: dedupKey, Priority: priority, MaxAttempts: jobMaxAttempts, RunAt: time.Now()}, nil
+}
+
+// submitJobs adds jobs to the queue, and wakes up idle workers.
+func submitJobs(ctx context.Context, newJobs []Job) error {
+	added, err := Database.EnqueueJobs(ctx, newJobs)
+	if err != nil {
+		return err
+	}
+	metrics.Add("jobs_submitted", int64(added))
+	if jobs != nil && added > 0 {
+		jobs.notify()
+	}
+	return nil
+}
+
+type jobQueue struct {
+	wake     chan struct{}
+	stopping chan struct{}
+	wg       sync.WaitGroup
+}
+
+func startJobQueue(workers int) *jobQueue {
+	q := &jobQueue{wake: make(chan struct{}, 1), stopping: make(chan struct{})}
+	for range workers {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *jobQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *jobQueue) work() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case <-q.stopping:
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+		job, err := Database.ClaimJob(ctx, jobTimeout)
+		cancel()
+
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				logging.Error("Error claiming a job: %v", err)
+			}
+			select {
+			case <-q.stopping:
+				return
+			case <-q.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		// there might be more, let the next idle worker look
+		q.notify()
+		q.run(job)
+	}
+}
+
+func (q *jobQueue) run(job *Job) {
+	err := fmt.Errorf("%w: unknown kind %q", errJobPermanent, job.Kind)
+	if handler, ok := jobHandlers[job.Kind]; ok {
+		ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+		err = handler(ctx, job.Payload)
+		cancel()
+	}
+	metrics.Add("job_runs", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	if err == nil {
+		if err := Database.FinishJob(ctx, job.ID); err != nil {
+			logging.Error("Error finishing job %d: %v", job.ID, err)
+		}
+		return
+	}
+
+	metrics.Add("job_failures", 1)
+	var retryAt *time.Time
+	if !errors.Is(err, errJobPermanent) && job.Attempts < job.MaxAttempts {
+		at := time.Now().Add(jobRetryDelay(job.Attempts))
+		retryAt = &at
+		logging.Warn("Job %d (%v) failed, retrying at %v: %v", job.ID, job.Kind, at.Format(time.RFC3339), err)
+	} else {
+		metrics.Add("jobs_dead", 1)
+		logging.Error("Job %d (%v) failed for good after %d attempt(s): %v", job.ID, job.Kind, job.Attempts, err)
+	}
+
+	if err := Database.FailJob(ctx, job, err.Error(), retryAt); err != nil {
+		logging.Error("Error recording failure of job %d: %v", job.ID, err)
+	}
+}
+
+// jobRetryDelay is how long to wait after the given number of attempts.
+func jobRetryDelay(attempts int) time.Duration {
+	delay := jobBackoff
+	for i := 1; i < attempts && delay < maxJobBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxJobBackoff)
+}
+
+// stop makes the workers quit after their current job, and waits for them until ctx is done.
+// Jobs that don't finish in time are picked up again once their lease is over.
+func (q *jobQueue) stop(ctx context.Context) error {
+	close(q.stopping)
+
+	finished := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jobStats shows how many jobs are queued, running and dead, by kind.
+func jobStats(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	counts, err := Database.JobCounts(ctx)
+	if err != nil {
+		logging.Error("Error counting jobs: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to count jobs", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"counts": counts, "workers": jobWorkers})
+}
+
+// failedJobs lists dead jobs and jobs waiting for a retry.
+func failedJobs(c *gin.Context) {
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, 1000)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	failed, err := Database.FailedJobs(ctx, limit)
+	if err != nil {
+		logging.Error("Error loading failed jobs: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load jobs", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"jobs": failed})
+}
+
+// retryJobs runs failed jobs again right away, all of them (optionally only ?kind=) or the one in the path.
+func retryJobs(c *gin.Context) {
+	var id int64
+	if value := c.Param("id"); value != "" {
+		var err error
+		id, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 1 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID", "ok": false})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	retried, err := Database.RetryJobs(ctx, id, c.Query("kind"))
+	if err != nil {
+		logging.Error("Error retrying jobs: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry jobs", "ok": false})
+		return
+	}
+	if id != 0 && retried == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "No failed job with that ID", "ok": false})
+		return
+	}
+	if jobs != nil && retried > 0 {
+		jobs.notify()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"retried": retried, "ok": true})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobRetryDelay(t *testing.T) {
+	defer func(backoff, max time.Duration) { jobBackoff, maxJobBackoff = backoff, max }(jobBackoff, maxJobBackoff)
+	jobBackoff, maxJobBackoff = time.Minute, time.Hour
+
+	for _, tt := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour}, // 64 minutes, capped
+		{1000, time.Hour},
+	} {
+		if got := jobRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("jobRetryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func testJob(t *testing.T, kind, dedupKey string, priority int) Job {
+	t.Helper()
+	job, err := newJob(kind, dedupKey, priority, map[string]string{"kind": kind})
+	if err != nil {
+		t.Fatalf("newJob failed: %v", err)
+	}
+	return job
+}
+
+func enqueue(t *testing.T, d *sqlDB, jobs ...Job) int {
+	t.Helper()
+	added, err := d.EnqueueJobs(context.Background(), jobs)
+	if err != nil {
+		t.Fatalf("EnqueueJobs failed: %v", err)
+	}
+	return added
+}
+
+func claim(t *testing.T, d *sqlDB, lease time.Duration) *Job {
+	t.Helper()
+	job, err := d.ClaimJob(context.Background(), lease)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("ClaimJob failed: %v", err)
+	}
+	return job
+}
+
+func jobState(t *testing.T, d *sqlDB, id int64) (state string, attempts int) {
+	t.Helper()
+	err := d.db.QueryRow(`SELECT state, attempts FROM jobs WHERE id = $1`, id).Scan(&state, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0
+	}
+	if err != nil {
+		t.Fatalf("Failed to load job %d: %v", id, err)
+	}
+	return state, attempts
+}
+
+func TestClaimJob(t *testing.T) {
+	d := openTestDB(t)
+
+	later := testJob(t, jobDownload, "", jobPriorityDownload)
+	later.RunAt = time.Now().Add(time.Hour)
+	enqueue(t, d,
+		testJob(t, jobDownload, "", jobPriorityDownload),
+		testJob(t, jobRefresh, "", jobPriorityRefresh),
+		later,
+		testJob(t, jobArchive, "", jobPriorityArchive),
+	)
+
+	// highest priority first, the job that isn't due yet not at all
+	for _, kind := range []string{jobRefresh, jobArchive, jobDownload} {
+		job := claim(t, d, time.Minute)
+		if job == nil {
+			t.Fatalf("Expected a %v job, got none", kind)
+		}
+		if job.Kind != kind || job.State != jobRunning || job.Attempts != 1 {
+			t.Errorf("Expected a running %v job after 1 attempt, got %v %v after %d", kind, job.State, job.Kind, job.Attempts)
+		}
+	}
+	if job := claim(t, d, time.Minute); job != nil {
+		t.Errorf("Expected no due job, got %v %d", job.Kind, job.ID)
+	}
+}
+
+func TestClaimJobLeaseExpiry(t *testing.T) {
+	d := openTestDB(t)
+	enqueue(t, d, testJob(t, jobDownload, "", jobPriorityDownload))
+
+	// an expired lease means the worker is gone, so the job is due again
+	first := claim(t, d, -time.Second)
+	if first == nil {
+		t.Fatal("Expected a job, got none")
+	}
+	second := claim(t, d, time.Minute)
+	if second == nil || second.ID != first.ID || second.Attempts != 2 {
+		t.Fatalf("Expected job %d again after its lease expired, got %+v", first.ID, second)
+	}
+
+	if job := claim(t, d, time.Minute); job != nil {
+		t.Errorf("Expected the leased job not to be claimed again, got %d", job.ID)
+	}
+}
+
+func TestEnqueueJobsDedup(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+
+	if added := enqueue(t, d, testJob(t, jobDownload, "download:a", 0), testJob(t, jobDownload, "download:a", 0)); added != 1 {
+		t.Fatalf("Expected 1 of 2 jobs with the same key to be added, got %d", added)
+	}
+	if added := enqueue(t, d, testJob(t, jobDownload, "", 0), testJob(t, jobDownload, "", 0)); added != 2 {
+		t.Errorf("Expected jobs without a key to be added, got %d of 2", added)
+	}
+
+	// still deduped while running
+	job := claim(t, d, time.Minute)
+	if job == nil || job.DedupKey != "download:a" {
+		t.Fatalf("Expected the job with the key, got %+v", job)
+	}
+	if added := enqueue(t, d, testJob(t, jobDownload, "download:a", 0)); added != 0 {
+		t.Errorf("Expected a running job to dedup, got %d added", added)
+	}
+
+	// dead jobs don't
+	if err := d.FailJob(ctx, job, "gone", nil); err != nil {
+		t.Fatalf("FailJob failed: %v", err)
+	}
+	if added := enqueue(t, d, testJob(t, jobDownload, "download:a", 0)); added != 1 {
+		t.Errorf("Expected a dead job not to dedup, got %d added", added)
+	}
+}
+
+func TestFailJob(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+	enqueue(t, d, testJob(t, jobDownload, "download:a", 0))
+
+	job := claim(t, d, time.Minute)
+	retryAt := time.Now().Add(time.Hour)
+	if err := d.FailJob(ctx, job, "try later", &retryAt); err != nil {
+		t.Fatalf("FailJob failed: %v", err)
+	}
+	if state, attempts := jobState(t, d, job.ID); state != jobQueued || attempts != 1 {
+		t.Errorf("Expected a queued job after 1 attempt, got %v after %d", state, attempts)
+	}
+	if next := claim(t, d, time.Minute); next != nil {
+		t.Fatalf("Expected the job to wait for its retry, got %d", next.ID)
+	}
+
+	retryAt = time.Now().Add(-time.Second)
+	if err := d.FailJob(ctx, job, "try now", &retryAt); err != nil {
+		t.Fatalf("FailJob failed: %v", err)
+	}
+	job = claim(t, d, time.Minute)
+	if job == nil || job.Attempts != 2 || job.LastError != "try now" {
+		t.Fatalf("Expected the job to be due again, got %+v", job)
+	}
+
+	if err := d.FailJob(ctx, job, "for good", nil); err != nil {
+		t.Fatalf("FailJob failed: %v", err)
+	}
+	if state, _ := jobState(t, d, job.ID); state != jobDead {
+		t.Errorf("Expected a dead job, got %q", state)
+	}
+
+	// of the dead jobs with the same key, only the latest is kept
+	enqueue(t, d, testJob(t, jobDownload, "download:a", 0))
+	again := claim(t, d, time.Minute)
+	if err := d.FailJob(ctx, again, "for good again", nil); err != nil {
+		t.Fatalf("FailJob failed: %v", err)
+	}
+	if state, _ := jobState(t, d, job.ID); state != "" {
+		t.Errorf("Expected the older dead job to be gone, got %q", state)
+	}
+	if state, _ := jobState(t, d, again.ID); state != jobDead {
+		t.Errorf("Expected the latest dead job to be kept, got %q", state)
+	}
+}
+
+func TestRetryJobs(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+
+	kill := func(job Job) *Job {
+		t.Helper()
+		enqueue(t, d, job)
+		claimed := claim(t, d, time.Minute)
+		if err := d.FailJob(ctx, claimed, "failed", nil); err != nil {
+			t.Fatalf("FailJob failed: %v", err)
+		}
+		return claimed
+	}
+	download := kill(testJob(t, jobDownload, "download:a", 0))
+	refresh := kill(testJob(t, jobRefresh, "", 0))
+	blocked := kill(testJob(t, jobDownload, "download:b", 0))
+	// queued again in the meantime, so retrying the dead one would break the dedup
+	enqueue(t, d, testJob(t, jobDownload, "download:b", 0))
+
+	if retried, err := d.RetryJobs(ctx, 0, jobRefresh); err != nil || retried != 1 {
+		t.Fatalf("Expected 1 refresh job to be retried, got %d: %v", retried, err)
+	}
+	if state, attempts := jobState(t, d, refresh.ID); state != jobQueued || attempts != 0 {
+		t.Errorf("Expected a queued job with fresh attempts, got %v after %d", state, attempts)
+	}
+
+	if retried, err := d.RetryJobs(ctx, download.ID, ""); err != nil || retried != 1 {
+		t.Fatalf("Expected the download to be retried, got %d: %v", retried, err)
+	}
+	if state, _ := jobState(t, d, download.ID); state != jobQueued {
+		t.Errorf("Expected the download to be queued, got %q", state)
+	}
+
+	if retried, err := d.RetryJobs(ctx, blocked.ID, ""); err != nil || retried != 0 {
+		t.Errorf("Expected the job with a queued duplicate not to be retried, got %d: %v", retried, err)
+	}
+	if state, _ := jobState(t, d, blocked.ID); state != jobDead {
+		t.Errorf("Expected the job with a queued duplicate to stay dead, got %q", state)
+	}
+}
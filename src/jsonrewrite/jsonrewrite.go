@@ -0,0 +1,163 @@
+package jsonrewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Path is where a value is in the document, object keys and array indices, e.g. ["posts", "0", "file", "url"].
+type Path []string
+
+// Match reports whether the path is exactly pattern, where "*" matches any single key or index.
+func (p Path) Match(pattern ...string) bool {
+	if len(p) != len(pattern) {
+		return false
+	}
+	for i, part := range pattern {
+		if part != "*" && part != p[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Index returns the array index at position i of the path, e.g. Index(1) of ["posts", "3", ...] is 3.
+func (p Path) Index(i int) (int, bool) {
+	if i < 0 || i >= len(p) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(p[i])
+	return n, err == nil
+}
+
+// Func gets every string and null value of the document. value is nil for null.
+// If it returns true, the value is replaced with the returned string.
+type Func func(path Path, value *string) (string, bool)
+
+type frame struct {
+	object    bool
+	key       string // current key, for objects
+	index     int    // current index, for arrays
+	expectKey bool
+}
+
+// Rewrite calls fn for every string and null value in doc, and returns doc with the values fn replaced.
+// Everything else stays exactly as it was, byte for byte, including fields we don't know about, number formatting and whitespace.
+func Rewrite(doc []byte, fn Func) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+
+	var out bytes.Buffer
+	out.Grow(len(doc))
+	copied := 0 // doc[:copied] is already in out
+
+	var stack []*frame
+	started := false
+	path := func() Path {
+		p := make(Path, len(stack))
+		for i, f := range stack {
+			if f.object {
+				p[i] = f.key
+			} else {
+				p[i] = strconv.Itoa(f.index)
+			}
+		}
+		return p
+	}
+	// valueDone moves the innermost object or array on to its next element
+	valueDone := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := stack[len(stack)-1]
+		if top.object {
+			top.expectKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	for {
+		before := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			// Token doesn't complain about documents that stop in the middle
+			if len(stack) > 0 || !started {
+				return nil, io.ErrUnexpectedEOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		after := int(dec.InputOffset())
+		if started && len(stack) == 0 {
+			return nil, fmt.Errorf("more than one value in the document at offset %d", before)
+		}
+		started = true
+
+		switch tok := tok.(type) {
+		case json.Delim:
+			switch tok {
+			case '{':
+				stack = append(stack, &frame{object: true, expectKey: true})
+			case '[':
+				stack = append(stack, &frame{})
+			default:
+				stack = stack[:len(stack)-1]
+				valueDone()
+			}
+			continue
+
+		case string:
+			if len(stack) > 0 && stack[len(stack)-1].object && stack[len(stack)-1].expectKey {
+				stack[len(stack)-1].key = tok
+				stack[len(stack)-1].expectKey = false
+				continue
+			}
+			if replacement, ok := fn(path(), &tok); ok {
+				copied = splice(&out, doc, copied, valueStart(doc, before), after, replacement)
+			}
+
+		case nil:
+			if replacement, ok := fn(path(), nil); ok {
+				copied = splice(&out, doc, copied, valueStart(doc, before), after, replacement)
+			}
+		}
+
+		valueDone()
+	}
+
+	out.Write(doc[copied:])
+	return out.Bytes(), nil
+}
+
+// valueStart skips the whitespace and separators the decoder consumed before a value.
+func valueStart(doc []byte, offset int) int {
+	for offset < len(doc) {
+		switch doc[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// splice copies doc up to start, then the replacement instead of doc[start:end], and returns end.
+func splice(out *bytes.Buffer, doc []byte, copied, start, end int, replacement string) int {
+	out.Write(doc[copied:start])
+
+	// no HTML escaping, & in urls should stay &
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.Encode(replacement)
+	out.Truncate(out.Len() - 1) // Encode adds a newline
+
+	return end
+}
@@ -0,0 +1,151 @@
+package jsonrewrite
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// proxyURLs replaces file, preview and sample urls, like the proxy does
+func proxyURLs(path Path, value *string) (string, bool) {
+	if len(path) < 2 || path[len(path)-1] != "url" {
+		return "", false
+	}
+	switch path[len(path)-2] {
+	case "file", "preview", "sample":
+	default:
+		return "", false
+	}
+	if value == nil {
+		return "https://cache.test/media/missing?path=" + strings.Join(path, "."), true
+	}
+	return "https://cache.test/media?src=" + *value + "&sig=abc", true
+}
+
+func testFiles(t *testing.T) []string {
+	files, err := filepath.Glob("testdata/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No test files: %v", err)
+	}
+	return files
+}
+
+func TestGolden(t *testing.T) {
+	for _, file := range testFiles(t) {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Rewrite(input, proxyURLs)
+			if err != nil {
+				t.Fatalf("Rewrite failed: %v", err)
+			}
+
+			golden := strings.TrimSuffix(file, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Missing golden file, run with -update: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Output differs from %v:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	for _, file := range testFiles(t) {
+		input, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen := 0
+		got, err := Rewrite(input, func(path Path, value *string) (string, bool) {
+			seen++
+			return "", false
+		})
+		if err != nil {
+			t.Fatalf("Rewrite of %v failed: %v", file, err)
+		}
+		if !bytes.Equal(got, input) {
+			t.Errorf("%v changed without replacing anything:\n%s", file, got)
+		}
+		if seen == 0 {
+			t.Errorf("No values in %v", file)
+		}
+	}
+}
+
+func TestPaths(t *testing.T) {
+	doc := []byte(`{"a":[{"b":null},"c",1,["d"]],"e":{"":"f"},"g":"h"}`)
+
+	var paths []string
+	_, err := Rewrite(doc, func(path Path, value *string) (string, bool) {
+		v := "null"
+		if value != nil {
+			v = *value
+		}
+		paths = append(paths, strings.Join(path, "/")+"="+v)
+		return "", false
+	})
+	if err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+
+	want := "a/0/b=null a/1=c a/3/0=d e/=f g=h"
+	if got := strings.Join(paths, " "); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestReplaceEscaping(t *testing.T) {
+	doc := []byte(`{ "url" : "https:\/\/static1.e621.net\/a.jpg" , "other":null }`)
+
+	got, err := Rewrite(doc, func(path Path, value *string) (string, bool) {
+		if value == nil {
+			return `"quoted" & <tag> ü`, true
+		}
+		return *value + "?a=1&b=2", true
+	})
+	if err != nil {
+		t.Fatalf("Rewrite failed: %v", err)
+	}
+
+	want := `{ "url" : "https://static1.e621.net/a.jpg?a=1&b=2" , "other":"\"quoted\" & <tag> ü" }`
+	if string(got) != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, doc := range []string{``, `{"a":`, `{"a" 1}`, `[1,]`, `{"a":1}}`, `{"a":1} x`, `{} {}`, `"a" "b"`} {
+		if _, err := Rewrite([]byte(doc), proxyURLs); err == nil {
+			t.Errorf("Expected an error for %s", doc)
+		}
+	}
+}
+
+func TestPathMatch(t *testing.T) {
+	p := Path{"posts", "3", "file", "url"}
+	if !p.Match("posts", "*", "file", "url") || p.Match("posts", "*", "file") || p.Match("post", "*", "file", "url") {
+		t.Errorf("Match doesn't work")
+	}
+	if i, ok := p.Index(1); !ok || i != 3 {
+		t.Errorf("Expected index 3, got %v, %v", i, ok)
+	}
+	if _, ok := p.Index(0); ok {
+		t.Errorf("posts is not an index")
+	}
+}
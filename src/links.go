@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+type linkVariant string
+
+const (
+	variantOriginal linkVariant = "original"
+	variantSample   linkVariant = "sample"
+	variantPreview  linkVariant = "preview"
+	// the video versions in sample.alternates, their links are /media/{md5}/{name}.{ext}
+	variantAlternate linkVariant = "alternate"
+)
+
+var (
+	// how long links to each variant stay valid, 0 means forever. Set with LINK_EXPIRY_<VARIANT>.
+	linkExpiry = map[linkVariant]time.Duration{}
+	// if links only work for the user they were handed to, set with LINK_BIND_USER
+	linkBindUser = false
+)
+
+// linkExpiresAt returns the unix timestamp a new link for the variant expires at, or 0 if it doesn't.
+// It gets rounded up, so the same file keeps the same link for a while and clients can cache it.
+func linkExpiresAt(variant linkVariant) int64 {
+	ttl := linkExpiry[variant]
+	if ttl <= 0 {
+		return 0
+	}
+
+	granularity := max(ttl/4, time.Minute)
+	return time.Now().Add(ttl).Truncate(granularity).Add(granularity).Unix()
+}
+
+// linkPayload is what gets signed for a link. Every field is always in it, and the resource is prefixed with its length,
+// so no resource can pass for another one with a different expiry or user.
+func linkPayload(resource string, expires int64, user string) string {
+	return "v1|" + strconv.Itoa(len(resource)) + "|" + resource + "|" + strconv.FormatInt(expires, 10) + "|" + user
+}
+
+// validResource reports if resource can be in a link. gin decodes the path, so control characters could end up in it.
+func validResource(resource string) bool {
+	return resource != "" && strings.IndexFunc(resource, unicode.IsControl) == -1
+}
+
+// signLink returns the query string (without "?") for a link to resource
+func signLink(resource string, variant linkVariant, user string) string {
+	query := url.Values{}
+
+	expires := linkExpiresAt(variant)
+	if expires != 0 {
+		query.Set("exp", strconv.FormatInt(expires, 10))
+	}
+
+	if !linkBindUser {
+		user = ""
+	}
+	if user != "" {
+		query.Set("u", user)
+	}
+
+	query.Set("sig", Signer.Sign(linkPayload(resource, expires, user)))
+	return query.Encode()
+}
+
+// verifyLink checks the signature, expiry and user of a link to resource. If it fails, the request gets aborted.
+func verifyLink(c *gin.Context, resource string) bool {
+	if !validResource(resource) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid link", "ok": false})
+		return false
+	}
+
+	sig := c.Query("sig")
+	if sig == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Missing signature", "ok": false})
+		return false
+	}
+
+	var expires int64
+	if exp := c.Query("exp"); exp != "" {
+		var err error
+		expires, err = strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry", "ok": false})
+			return false
+		}
+	}
+	user := c.Query("u")
+
+	if !Signer.Verify(linkPayload(resource, expires, user), sig) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid signature", "ok": false})
+		return false
+	}
+
+	if expires != 0 && time.Now().Unix() > expires {
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"error": "Link expired", "ok": false})
+		return false
+	}
+
+	if user != "" {
+		requestUser, ok := authenticate(c)
+		if !ok || requestUser != user {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Link belongs to another user", "ok": false})
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifyLegacyLink checks an old /proxy link, which only signed the upstream url. Those never had an expiry or user,
+// and a url can't pass for a linkPayload, which starts with "v1|". Everything else goes through verifyLink.
+func verifyLegacyLink(c *gin.Context, upstreamURL string) bool {
+	legacy := c.Query("exp") == "" && c.Query("u") == "" &&
+		(strings.HasPrefix(upstreamURL, "https://") || strings.HasPrefix(upstreamURL, "http://"))
+	if legacy && validResource(upstreamURL) && Signer.Verify(upstreamURL, c.Query("sig")) {
+		return true
+	}
+	return verifyLink(c, upstreamURL)
+}
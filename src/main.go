@@ -4,16 +4,21 @@ import (
 	"bugmaschine/e6-cache/logging"
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"bugmaschine/e6-cache/signer"
+	"bugmaschine/e6-cache/storage"
 
 	"github.com/getkin/kin-openapi/openapi3"
 
@@ -30,20 +35,27 @@ var (
 	Database      DB
 	useragentBase = "e6-cache (https://github.com/bugmaschine/e6-cache)"
 	port          = ":8080"
-	Key           []byte            // gets randomly generated every launch, and used for signing the urls.
 	maxCacheAge   = 1 * time.Hour   // idk what's a good value, but 1 hours seems enough
 	Signer        *signer.Signer    // feel free to sugest a better name
 	globalTimeout = 5 * time.Second // global timeout for requests to e6, if it takes longer than this, we assume the request failed.
 
 	// env stuff
 
+	// Storage
+	STORAGE_BACKEND = "s3"
+	STORAGE_PATH    string
+	MediaStorage    storage.Storage
+
 	// S3
 	S3_BUCKET_NAME string
 	S3_REGION      string
 	S3_ACCESS_KEY  string
 	S3_SECRET_KEY  string
 	S3_ENDPOINT    string
-	S3             S3Service
+
+	// Database
+	DB_DRIVER = "postgres"
+	DB_PATH   = "e6-cache.db" // SQLite file
 
 	// PostgreSQL
 	DB_HOST string
@@ -57,6 +69,16 @@ var (
 	baseURL    string
 	PROXY_AUTH string
 
+	// Signing keys for proxy links, see loadSigner
+	SIGNING_KEYS     string
+	SIGNING_KEY_FILE string
+
+	// Admin API, disabled when empty
+	ADMIN_AUTH string
+
+	// Offline mode
+	offlineMode = offlineFallback // what to do when E6_BASE is unreachable, see offline.go
+
 	//go:embed "openapi/e621.yaml"
 	e621OpenApiRoutes []byte // embedded OpenAPI routes, used to dynamically register the routes in the gin router.
 )
@@ -67,18 +89,32 @@ func loadEnv() {
 		logging.Warn("Error loading .env file")
 	}
 
+	if backend := os.Getenv("STORAGE_BACKEND"); backend != "" {
+		STORAGE_BACKEND = strings.ToLower(backend)
+	}
+	STORAGE_PATH = os.Getenv("STORAGE_PATH")
+
 	S3_BUCKET_NAME = os.Getenv("S3_BUCKET")
 	S3_REGION = os.Getenv("S3_REGION")
 	S3_ACCESS_KEY = os.Getenv("S3_ACCESS_KEY")
 	S3_SECRET_KEY = os.Getenv("S3_SECRET_KEY")
 	S3_ENDPOINT = os.Getenv("S3_ENDPOINT")
 
+	if driver := os.Getenv("DB_DRIVER"); driver != "" {
+		DB_DRIVER = strings.ToLower(driver)
+	}
+	if path := os.Getenv("DB_PATH"); path != "" {
+		DB_PATH = path
+	}
+
 	DB_HOST = os.Getenv("DB_HOST")
-	i, err := strconv.Atoi(os.Getenv("DB_PORT"))
-	if err != nil {
-		logging.Fatal("Error converting DB_PORT to int")
+	if DB_DRIVER == "postgres" {
+		i, err := strconv.Atoi(os.Getenv("DB_PORT"))
+		if err != nil {
+			logging.Fatal("Error converting DB_PORT to int")
+		}
+		DB_PORT = i
 	}
-	DB_PORT = i
 	DB_NAME = os.Getenv("DB_NAME")
 	DB_USER = os.Getenv("DB_USER")
 	DB_PASS = os.Getenv("DB_PASS")
@@ -87,6 +123,125 @@ func loadEnv() {
 	PROXY_URL = os.Getenv("PROXY_URL")
 	baseURL = os.Getenv("E6_BASE")
 	PROXY_AUTH = os.Getenv("PROXY_AUTH")
+	ADMIN_AUTH = os.Getenv("ADMIN_AUTH")
+
+	SIGNING_KEYS = os.Getenv("SIGNING_KEYS")
+	SIGNING_KEY_FILE = os.Getenv("SIGNING_KEY_FILE")
+
+	for variant, env := range map[linkVariant]string{
+		variantOriginal:  "LINK_EXPIRY_ORIGINAL",
+		variantSample:    "LINK_EXPIRY_SAMPLE",
+		variantPreview:   "LINK_EXPIRY_PREVIEW",
+		variantAlternate: "LINK_EXPIRY_ALTERNATE",
+	} {
+		if value := os.Getenv(env); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				logging.Fatal("Error parsing %v: %v", env, err)
+			}
+			linkExpiry[variant] = d
+		}
+	}
+	for env, target := range map[string]*time.Duration{
+		"NEGATIVE_CACHE_TTL": &negativeCacheTTL,
+		"INGEST_TIMEOUT":     &ingestTimeout,
+		"SHUTDOWN_TIMEOUT":   &shutdownTimeout,
+		"REFRESH_INTERVAL":   &refreshInterval,
+		"REFRESH_MAX_AGE":    &refreshMaxAge,
+		"JOB_BACKOFF":        &jobBackoff,
+		"ARCHIVE_DELAY":      &archiveDelay,
+	} {
+		if value := os.Getenv(env); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				logging.Fatal("Error parsing %v: %v", env, err)
+			}
+			*target = d
+		}
+	}
+
+	spoolDir = os.Getenv("SPOOL_DIR")
+
+	writeBehind = os.Getenv("WRITE_BEHIND") == "true"
+	if value := os.Getenv("WRITE_QUEUE_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			logging.Fatal("Invalid WRITE_QUEUE_SIZE %q", value)
+		}
+		writeQueueSize = size
+	}
+
+	if value := os.Getenv("STATIC_BASE"); value != "" {
+		staticBase = strings.TrimSuffix(value, "/")
+	}
+	switch policy := hiddenFilesPolicy(strings.ToLower(os.Getenv("HIDDEN_FILES"))); policy {
+	case "":
+		// keep the default
+	case hiddenFilesOff, hiddenFilesArchived, hiddenFilesAll:
+		hiddenFiles = policy
+	default:
+		logging.Fatal("Invalid HIDDEN_FILES %q, expected off, archived or all", policy)
+	}
+	if value := os.Getenv("HIDDEN_FILES_USERS"); value != "" {
+		for _, user := range strings.Split(value, ",") {
+			if user = strings.TrimSpace(user); user != "" {
+				hiddenFilesUsers[user] = true
+			}
+		}
+	}
+
+	for _, name := range strings.Split(os.Getenv("EAGER_ALTERNATES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			eagerAlternates[name] = true
+		}
+	}
+	for env, target := range map[string]*int{
+		"JOB_WORKERS":      &jobWorkers,
+		"JOB_MAX_ATTEMPTS": &jobMaxAttempts,
+	} {
+		if value := os.Getenv(env); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || (n == 0 && env != "JOB_WORKERS") {
+				logging.Fatal("Invalid %v %q", env, value)
+			}
+			*target = n
+		}
+	}
+
+	if value := os.Getenv("REFRESH_BATCH_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > maxRefreshBatchSize {
+			logging.Fatal("Invalid REFRESH_BATCH_SIZE %q, expected 1 to %d", value, maxRefreshBatchSize)
+		}
+		refreshBatchSize = size
+	}
+	refreshPinned = os.Getenv("REFRESH_ONLY_PINNED") == "true"
+	upstreamAuth = os.Getenv("UPSTREAM_AUTH")
+
+	prefetch = os.Getenv("PREFETCH") == "true"
+	if value := os.Getenv("PREFETCH_ORIGINAL_MAX_MB"); value != "" {
+		mb, err := strconv.Atoi(value)
+		if err != nil || mb < 0 {
+			logging.Fatal("Invalid PREFETCH_ORIGINAL_MAX_MB %q", value)
+		}
+		prefetchOriginalMaxSize = mb * 1024 * 1024
+	}
+
+	linkBindUser = os.Getenv("LINK_BIND_USER") == "true"
+	if linkBindUser && PROXY_AUTH == "" {
+		// without it, the user is whatever username the client sends, so binding to it protects nothing
+		logging.Fatal("LINK_BIND_USER needs PROXY_AUTH")
+	}
+
+	switch mode := strings.ToLower(os.Getenv("OFFLINE_MODE")); mode {
+	case "":
+		// keep the default
+	case offlineOff, offlineFallback, offlineOnly:
+		offlineMode = mode
+	default:
+		logging.Fatal("Invalid OFFLINE_MODE %q, expected off, fallback or only", mode)
+	}
+	logging.Info("Offline mode: %v", offlineMode)
 
 	if PROXY_AUTH != "" {
 		logging.Info("Proxy auth is enabled with key: %v", PROXY_AUTH)
@@ -102,14 +257,19 @@ func main() {
 	logging.Info("Starting e6-cache...")
 	loadEnv()
 
-	// generate signing key
-	Key = signer.GenerateSecretKey()
-	Signer = signer.NewSigner(Key)
-	logging.Debug("Generated key: %v", Key)
-
 	// setup db
-	logging.Info("Connecting to DB...")
-	d, err := newDB(DB_HOST, DB_NAME, DB_USER, DB_PASS, DB_PORT)
+	var d DB
+	var err error
+	switch DB_DRIVER {
+	case "postgres":
+		logging.Info("Connecting to DB...")
+		d, err = newDB(DB_HOST, DB_NAME, DB_USER, DB_PASS, DB_PORT)
+	case "sqlite":
+		logging.Info("Opening SQLite database %v...", DB_PATH)
+		d, err = newSQLiteDB(DB_PATH)
+	default:
+		logging.Fatal("Invalid DB_DRIVER %q, expected postgres or sqlite", DB_DRIVER)
+	}
 	if err != nil {
 		logging.Info("Failed to connect to DB (is it up?): %v", err)
 		return
@@ -117,16 +277,70 @@ func main() {
 	Database = d
 	logging.Info("Connected to DB!")
 
-	// setup s3
-	logging.Info("Connecting to S3...")
-	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
-	defer cancel()
-	s3Svc, err := NewS3Service(ctx, S3_REGION, S3_ENDPOINT, S3_ACCESS_KEY, S3_SECRET_KEY, S3_BUCKET_NAME)
-	if err != nil {
-		logging.Fatal("Failed to connect to S3: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrateCommand(d, os.Args[2:])
+		return
+	}
+	migrateOnStart(d)
+
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		reindexCommand(d, os.Args[2:])
+		return
+	}
+
+	Signer = loadSigner()
+
+	if writeBehind {
+		logging.Info("Saving posts in the background (queue size %d)", writeQueueSize)
+		postWrites = startPostWriter(writeQueueSize)
+	}
+
+	// setup storage
+	switch STORAGE_BACKEND {
+	case "s3":
+		logging.Info("Connecting to S3...")
+		ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+		defer cancel()
+		s3Svc, err := NewS3Service(ctx, S3_REGION, S3_ENDPOINT, S3_ACCESS_KEY, S3_SECRET_KEY, S3_BUCKET_NAME)
+		if err != nil {
+			logging.Fatal("Failed to connect to S3: %v", err)
+		}
+		MediaStorage = s3Svc
+		logging.Info("Connected to S3!")
+	case "local":
+		local, err := storage.NewLocal(STORAGE_PATH)
+		if err != nil {
+			logging.Fatal("Failed to set up local storage: %v", err)
+		}
+		MediaStorage = local
+		logging.Info("Storing files in %v", STORAGE_PATH)
+	default:
+		logging.Fatal("Invalid STORAGE_BACKEND %q, expected s3 or local", STORAGE_BACKEND)
+	}
+
+	if len(eagerAlternates) > 0 {
+		logging.Info("Downloading alternates %v in the background", os.Getenv("EAGER_ALTERNATES"))
+	}
+	if prefetch {
+		logging.Info("Prefetching previews and samples of listed posts, and originals up to %d MB", prefetchOriginalMaxSize/1024/1024)
+	}
+	archiving := len(os.Args) > 1 && os.Args[1] == "archive"
+	if archiving && jobWorkers == 0 {
+		// the archive command waits for its jobs, nobody else might be running them
+		jobWorkers = 1
+	}
+	logging.Info("Running background jobs with %d worker(s)", jobWorkers)
+	jobs = startJobQueue(jobWorkers)
+
+	if archiving {
+		archiveCommand(os.Args[2:])
+		return
+	}
+
+	if refreshInterval > 0 {
+		logging.Info("Refreshing up to %d posts older than %v every %v", refreshBatchSize, refreshMaxAge, refreshInterval)
+		refresher = startRefresher(refreshInterval)
 	}
-	S3 = *s3Svc
-	logging.Info("Connected to S3!")
 
 	// create gin router
 	router := gin.Default()
@@ -138,8 +352,12 @@ func main() {
 	// register e621 routes
 	parseOpenAPIRoutes(e621OpenApiRoutes, router)
 
-	// Proxy files from S3, if not save them.
-	router.GET("/proxy/:fileId", proxyFile)
+	// Proxy files from storage, if not save them.
+	router.GET("/media/:md5", mediaFile)
+	router.GET("/media/:md5/:variant", mediaFile)
+	router.GET("/proxy/:fileId", proxyFile) // old links, before /media existed
+
+	registerAdminRoutes(router)
 
 	router.GET("/", func(c *gin.Context) {
 		c.String(200, "e6-cache is running. Use this as the instance in your preffered client.\n"+
@@ -147,8 +365,72 @@ func main() {
 			"Server is caching following url: "+baseURL)
 	})
 
-	logging.Info("Started router at %v", port)
-	router.Run(port)
+	srv := &http.Server{Addr: port, Handler: router}
+	go func() {
+		logging.Info("Started router at %v", port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("Failed to start router: %v", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	// stop taking requests, then give running ingestions a chance to finish, so we don't lose files
+	logging.Info("Shutting down, waiting for %d running ingestion(s)...", ingestions.count())
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+
+	serverErr := srv.Shutdown(shutdownCtx)
+	if serverErr != nil {
+		logging.Warn("Failed to close all connections: %v", serverErr)
+	}
+	if refresher != nil {
+		refresher.stop()
+	}
+	if err := jobs.stop(shutdownCtx); err != nil {
+		logging.Warn("Shutdown timeout reached before all running jobs finished, they run again after the next start")
+	}
+	if err := ingestions.wait(shutdownCtx); err != nil {
+		logging.Warn("Shutdown timeout reached before all ingestions finished")
+	}
+
+	// handlers that are still running could still queue posts, closing the queue under them would crash
+	if postWrites != nil && serverErr == nil {
+		if err := postWrites.close(shutdownCtx); err != nil {
+			logging.Warn("Shutdown timeout reached before all queued posts were saved")
+		}
+	}
+	logging.Info("Bye!")
+}
+
+// loadSigner loads the keys for signing proxy links from SIGNING_KEYS or SIGNING_KEY_FILE.
+// Without either, a random key is used and all links break on restart.
+func loadSigner() *signer.Signer {
+	var keys []signer.Key
+	var err error
+
+	switch {
+	case SIGNING_KEYS != "":
+		keys, err = signer.ParseKeys(strings.NewReader(SIGNING_KEYS))
+	case SIGNING_KEY_FILE != "":
+		keys, err = signer.LoadOrCreateKeyFile(SIGNING_KEY_FILE)
+	default:
+		logging.Warn("Neither SIGNING_KEYS nor SIGNING_KEY_FILE is set, using a random key. Proxy links will break on restart!")
+		return signer.NewSigner(signer.GenerateSecretKey())
+	}
+	if err != nil {
+		logging.Fatal("Failed to load signing keys: %v", err)
+	}
+
+	s, err := signer.NewMultiKeySigner(keys)
+	if err != nil {
+		logging.Fatal("Invalid signing keys: %v", err)
+	}
+
+	logging.Info("Loaded %d signing key(s), signing with %v", len(keys), keys[0].ID)
+	return s
 }
 
 func parseOpenAPIRoutes(openapifile []byte, router *gin.Engine) {
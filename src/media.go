@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/httprange"
+	"bugmaschine/e6-cache/logging"
+	"bugmaschine/e6-cache/storage"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// everything after "data/" in a static url, this is the object key
+	objectKeyRegex = regexp.MustCompile(`/data/(.+)`)
+	md5Regex       = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	// names and extensions of alternates, they end up in links
+	alternateRegex = regexp.MustCompile(`^[0-9a-z_]+$`)
+
+	// alternates that get downloaded as soon as their post is seen, by name (480p) or name and format (720p.mp4), * for all.
+	// The others are only downloaded once a client asks for them. Set with EAGER_ALTERNATES.
+	eagerAlternates = map[string]bool{}
+
+	// download the preview and sample of every post in a listing, set with PREFETCH
+	prefetch = false
+	// also download originals up to this many bytes, 0 for none. Set with PREFETCH_ORIGINAL_MAX_MB
+	prefetchOriginalMaxSize = 0
+)
+
+// objectKey returns the storage key of a static url. It doesn't include the host, so the same file on static1.e621.net and static1.e926.net ends up as the same object.
+func objectKey(fileURL string) (string, bool) {
+	matches := objectKeyRegex.FindStringSubmatch(fileURL)
+	if matches == nil {
+		return "", false
+	}
+	return matches[1], true
+}
+
+// mediaResource is what gets signed for a media link, it only identifies the content.
+func mediaResource(md5, ext string, variant linkVariant) string {
+	if variant == variantOriginal {
+		return md5 + "." + ext
+	}
+	return md5 + "/" + string(variant)
+}
+
+// alternateResource is what gets signed for a link to an alternate, see mediaResource.
+func alternateResource(md5, name, ext string) string {
+	return md5 + "/" + name + "." + ext
+}
+
+// urlExt returns the extension of a url without the dot, like webm.
+func urlExt(fileURL string) string {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(path.Ext(u.Path), ".")
+}
+
+// alternateURL returns the upstream url of an alternate of a post in the given format.
+func alternateURL(post *Post, name, ext string) (string, bool) {
+	for _, u := range post.Sample.Alternates[name].URLs {
+		if u != "" && urlExt(u) == ext {
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// ingestEagerAlternates queues the alternates of posts that are in EAGER_ALTERNATES for download.
+func ingestEagerAlternates(posts []*Post) {
+	if len(eagerAlternates) == 0 {
+		return
+	}
+
+	var downloads []downloadJob
+	for _, post := range posts {
+		downloads = append(downloads, alternateDownloads(post)...)
+	}
+	queueDownloads(downloads)
+}
+
+// prefetchMedia queues the preview and sample (and the original, if it's small enough) of posts from a listing,
+// so a page of search results works offline even if the client only loaded some of it.
+func prefetchMedia(posts []*Post) {
+	if !prefetch {
+		return
+	}
+
+	var downloads []downloadJob
+	for _, post := range posts {
+		variants := []linkVariant{variantPreview, variantSample}
+		if prefetchOriginalMaxSize > 0 && post.File.Size > 0 && post.File.Size <= prefetchOriginalMaxSize {
+			variants = append(variants, variantOriginal)
+		}
+		downloads = append(downloads, variantDownloads(post, variants...)...)
+	}
+	queueDownloads(downloads)
+}
+
+// alternateDownloads returns the downloads of the alternates of a post that are in EAGER_ALTERNATES.
+func alternateDownloads(post *Post) []downloadJob {
+	var downloads []downloadJob
+	for name, alternate := range post.Sample.Alternates {
+		for _, u := range alternate.URLs {
+			if u == "" || !(eagerAlternates["*"] || eagerAlternates[name] || eagerAlternates[name+"."+urlExt(u)]) {
+				continue
+			}
+			if key, ok := objectKey(u); ok {
+				downloads = append(downloads, downloadJob{Key: key, URL: u})
+			}
+		}
+	}
+	return downloads
+}
+
+// variantDownloads returns the downloads of variants of a post, with urls upstream hides rebuilt if HIDDEN_FILES allows it.
+func variantDownloads(post *Post, variants ...linkVariant) []downloadJob {
+	var downloads []downloadJob
+	for _, variant := range variants {
+		u := variantURL(post, variant)
+		// with HIDDEN_FILES=archived, hidden files only come from storage
+		if u == "" && hiddenFiles == hiddenFilesAll {
+			u = hiddenFileURL(post, variant)
+		}
+		if key, ok := objectKey(u); ok {
+			downloads = append(downloads, downloadJob{Key: key, URL: u})
+		}
+	}
+	return downloads
+}
+
+// variantURL returns the upstream url of the original, sample or preview of a post, "" if upstream didn't send one.
+func variantURL(post *Post, variant linkVariant) string {
+	switch variant {
+	case variantOriginal:
+		return post.File.URL
+	case variantSample:
+		return post.Sample.URL
+	case variantPreview:
+		return post.Preview.URL
+	}
+	return ""
+}
+
+// makeAlternateLink returns the link to upstreamURL, one of the urls of the alternate called name, or "" if it can't have one.
+func makeAlternateLink(post *Post, name, upstreamURL, user string) string {
+	ext := urlExt(upstreamURL)
+	if upstreamURL == "" || post.File.MD5 == "" || !alternateRegex.MatchString(name) || !alternateRegex.MatchString(ext) {
+		logging.Debug("No link for alternate %v of post %v: %v", name, post.ID, upstreamURL)
+		return ""
+	}
+
+	resource := alternateResource(post.File.MD5, name, ext)
+	return PROXY_URL + "/media/" + resource + "?" + signLink(resource, variantAlternate, user)
+}
+
+// makeProxyLink returns the link to a variant of a post, or "" if the file is hidden upstream and HIDDEN_FILES doesn't allow user to see it.
+// Deleted posts count as hidden even with the urls we stored before, see postUpsert.
+func makeProxyLink(post *Post, variant linkVariant, user string) string {
+	original := variantURL(post, variant)
+	if original == "" || post.Flags.Deleted {
+		if !canSeeHiddenFiles(user) {
+			logging.Debug("Not linking hidden %v of post %v", variant, post.ID)
+			return ""
+		}
+		if original == "" {
+			original = hiddenFileURL(post, variant)
+		}
+	}
+
+	if original == "" || post.File.MD5 == "" {
+		logging.Debug("No %v url for post %v", variant, post.ID)
+		return ""
+	}
+
+	resource := mediaResource(post.File.MD5, post.File.Ext, variant)
+
+	// We sign the content identity so a malicious attacker can't just change the url to download any file.
+	proxiedURL := PROXY_URL + "/media/" + resource + "?" + signLink(resource, variant, user)
+	logging.Debug("Creating proxy url for file: %v | Proxied URL: %v", original, proxiedURL)
+
+	return proxiedURL
+}
+
+// mediaFile serves /media/{md5}.{ext}, /media/{md5}/{variant} and /media/{md5}/{alternate}.{ext},
+// looking up the upstream url in the stored post.
+func mediaFile(c *gin.Context) {
+	md5 := c.Param("md5")
+	variant := linkVariant(c.Param("variant"))
+	ext := ""
+	alternate := ""
+
+	if variant == "" {
+		variant = variantOriginal
+		md5, ext, _ = strings.Cut(md5, ".")
+	} else if name, alternateExt, ok := strings.Cut(string(variant), "."); ok {
+		variant, alternate, ext = variantAlternate, name, alternateExt
+	}
+
+	valid := false
+	switch variant {
+	case variantOriginal:
+		valid = alternateRegex.MatchString(ext)
+	case variantSample, variantPreview:
+		valid = true
+	case variantAlternate:
+		valid = alternateRegex.MatchString(alternate) && alternateRegex.MatchString(ext)
+	}
+	if !md5Regex.MatchString(md5) || !valid {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Unknown file", "ok": false})
+		return
+	}
+
+	resource := mediaResource(md5, ext, variant)
+	if variant == variantAlternate {
+		resource = alternateResource(md5, alternate, ext)
+	}
+	if !verifyLink(c, resource) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	post, err := Database.GetPostByMD5(ctx, md5)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "File not found in archive", "ok": false})
+		return
+	}
+	if err != nil {
+		logging.Error("Error looking up post by md5 %v: %v", md5, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up file", "ok": false})
+		return
+	}
+	if variant == variantOriginal && ext != post.File.Ext {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Unknown file", "ok": false})
+		return
+	}
+
+	upstreamURL := variantURL(post, variant)
+	if variant == variantAlternate {
+		upstreamURL, _ = alternateURL(post, alternate, ext)
+	}
+
+	// the link might be from before the post was hidden, or for someone else, so check the user again
+	hidden := false
+	if upstreamURL == "" && variant != variantAlternate && canSeeHiddenFiles(mediaUser(c)) {
+		upstreamURL = hiddenFileURL(post, variant)
+		hidden = true
+	}
+
+	key, ok := objectKey(upstreamURL)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "File not found in archive", "ok": false})
+		return
+	}
+
+	if hidden && hiddenFiles == hiddenFilesArchived {
+		upstreamURL = ""
+	}
+	serveMedia(c, key, upstreamURL)
+}
+
+// mediaUser returns the user of a media request, "" if it's anonymous or the proxy auth is wrong.
+// Media routes don't go through the proxy middleware, most clients don't send auth for them anyway.
+func mediaUser(c *gin.Context) string {
+	if user := c.GetString(proxyUserKey); user != "" {
+		return user
+	}
+	user, ok := authenticate(c)
+	if !ok {
+		return ""
+	}
+	return user
+}
+
+// proxyFile serves the old /proxy/{base64 url} links, which are still around in client caches.
+func proxyFile(c *gin.Context) {
+	fileID := c.Param("fileId")
+
+	url, err := base64.URLEncoding.DecodeString(fileID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID", "ok": false})
+		return
+	}
+
+	if !verifyLegacyLink(c, string(url)) {
+		return
+	}
+
+	key, ok := objectKey(string(url))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID", "ok": false})
+		return
+	}
+
+	serveMedia(c, key, string(url))
+}
+
+// serveMedia streams the object from storage, or downloads it from upstreamURL while saving it.
+// Without upstreamURL, only what's in storage gets served.
+func serveMedia(c *gin.Context, key, upstreamURL string) {
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(maxCacheAge.Seconds())))
+	c.Header("Expires", time.Now().Add(maxCacheAge).Format(http.TimeFormat))
+
+	info, fileExists, err := statShared(key)
+	if err != nil {
+		logging.Error("Error checking storage, requesting the file from upstream: %v", err)
+	}
+
+	if fileExists {
+		logging.Info("File exists in storage, streaming: %v", key)
+		serveFromStorage(c, key, info)
+		return
+	}
+	if upstreamURL == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "File not found in archive", "ok": false})
+		return
+	}
+
+	// we only store whole files, so partial requests just get forwarded
+	if rangeHeader := c.GetHeader("Range"); rangeHeader != "" && !httprange.IsWholeFile(rangeHeader) {
+		forwardRange(c, upstreamURL)
+		return
+	}
+
+	// below only gets called when file does not exist in storage
+	logging.Debug("File not found in storage. Requesting it.")
+
+	if status, ok := mediaMisses.get(key); ok {
+		c.AbortWithStatusJSON(status, gin.H{"error": "Upstream failed to deliver this file recently", "ok": false})
+		return
+	}
+
+	// if someone else is already downloading it, read along instead of downloading it again
+	flight := joinMediaFlight(key, upstreamURL, true)
+	body, err := flight.reader()
+	if err != nil {
+		logging.Error("Failed to download %v: %v", upstreamURL, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to proxy request", "ok": false})
+		return
+	}
+	defer body.Close()
+
+	// Stream live to user
+	c.DataFromReader(flight.status, flight.contentLength, flight.contentType, body, nil)
+}
+
+// serveFromStorage streams an object to the client, answering Range and conditional requests.
+func serveFromStorage(c *gin.Context, key string, info storage.ObjectInfo) {
+	c.Header("Accept-Ranges", "bytes")
+	if info.ETag != "" {
+		c.Header("ETag", info.ETag)
+	}
+	if !info.LastModified.IsZero() {
+		c.Header("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if httprange.NotModified(c.Request.Header, info.ETag, info.LastModified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	contentType := contentTypeFor(key)
+
+	if rangeHeader := c.GetHeader("Range"); rangeHeader != "" && httprange.IfRange(c.Request.Header, info.ETag, info.LastModified) {
+		r, ok, err := httprange.Parse(rangeHeader, info.Size)
+		if errors.Is(err, httprange.ErrUnsatisfiable) {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			c.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		if ok {
+			body, err := MediaStorage.StreamRange(c, key, r.Start, r.End)
+			if err != nil {
+				logging.Error("Error reading range from storage: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to read from storage", "ok": false})
+				return
+			}
+			defer body.Close()
+
+			c.DataFromReader(http.StatusPartialContent, r.Length(), contentType, body, map[string]string{"Content-Range": r.ContentRange(info.Size)})
+			return
+		}
+	}
+
+	body, err := MediaStorage.Stream(c, key)
+	if err != nil {
+		logging.Error("Error reading from storage: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to read from storage", "ok": false})
+		return
+	}
+	defer body.Close()
+
+	c.DataFromReader(http.StatusOK, info.Size, contentType, body, nil)
+}
+
+// forwardRange passes a range request on to upstream, without storing anything.
+func forwardRange(c *gin.Context, upstreamURL string) {
+	req, err := http.NewRequestWithContext(c, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to proxy request", "ok": false})
+		return
+	}
+	for _, h := range []string{"Range", "If-Range"} {
+		if v := c.GetHeader(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	setUseragent("", req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to proxy request", "ok": false})
+		return
+	}
+	defer resp.Body.Close()
+
+	headers := map[string]string{}
+	for _, h := range []string{"Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		if v := resp.Header.Get(h); v != "" {
+			headers[h] = v
+		}
+	}
+
+	c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, headers)
+}
+
+func contentTypeFor(key string) string {
+	switch ext := filepath.Ext(key); ext {
+	// Images
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	case ".bmp":
+		return "image/bmp"
+	case ".tiff", ".tif":
+		return "image/tiff"
+
+	// Videos
+	case ".webm":
+		return "video/webm"
+	case ".mp4":
+		return "video/mp4"
+	case ".mov":
+		return "video/quicktime"
+	case ".avi":
+		return "video/x-msvideo"
+	case ".mkv":
+		return "video/x-matroska"
+	case ".flv":
+		return "video/x-flv"
+	case ".ogv":
+		return "video/ogg"
+
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	_ "modernc.org/sqlite"
+)
+
+var testFiles = fstest.MapFS{
+	"0002_add_notes.up.sql":   {Data: []byte(`CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT NOT NULL);`)},
+	"0002_add_notes.down.sql": {Data: []byte(`DROP TABLE notes;`)},
+	"0001_init.up.sql":        {Data: []byte(`CREATE TABLE posts (id INTEGER PRIMARY KEY); CREATE INDEX posts_id_idx ON posts (id);`)},
+	"0001_init.down.sql":      {Data: []byte(`DROP TABLE posts;`)},
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "test.db")+"?_txlock=immediate")
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = $1`, name).Scan(&count); err != nil {
+		t.Fatalf("Failed to look for table: %v", err)
+	}
+	return count > 0
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(testFiles)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Version != 2 {
+		t.Fatalf("Unexpected migrations: %+v", migrations)
+	}
+	if migrations[1].Name != "add_notes" || migrations[1].Down == "" {
+		t.Errorf("Unexpected migration: %+v", migrations[1])
+	}
+
+	invalid := []fstest.MapFS{
+		{"init.up.sql": {}},
+		{"0001_init.down.sql": {Data: []byte("DROP TABLE posts;")}},
+		{"0001_init.up.sql": {Data: []byte("SELECT 1;")}, "0001_other.down.sql": {Data: []byte("SELECT 1;")}},
+	}
+	for _, files := range invalid {
+		if _, err := Load(files); err == nil {
+			t.Errorf("Expected Load to fail for %v", files)
+		}
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migrations, err := Load(testFiles)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	m := New(db, SQLite, migrations)
+
+	// only the first one, like an older binary
+	applied, err := New(db, SQLite, migrations[:1]).Up(ctx)
+	if err != nil || len(applied) != 1 {
+		t.Fatalf("Up failed: %v, %+v", err, applied)
+	}
+
+	status, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if status[0].AppliedAt == nil || status[1].AppliedAt != nil {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	applied, err = m.Up(ctx)
+	if err != nil || len(applied) != 1 || applied[0].Version != 2 {
+		t.Fatalf("Up failed: %v, %+v", err, applied)
+	}
+	if !tableExists(t, db, "notes") {
+		t.Errorf("Migration 2 didn't run")
+	}
+
+	// nothing left to do
+	applied, err = m.Up(ctx)
+	if err != nil || len(applied) != 0 {
+		t.Errorf("Expected nothing to apply, got %v, %+v", err, applied)
+	}
+
+	undone, err := m.Down(ctx, 1)
+	if err != nil || len(undone) != 1 || undone[0].Version != 2 {
+		t.Fatalf("Down failed: %v, %+v", err, undone)
+	}
+	if tableExists(t, db, "notes") || !tableExists(t, db, "posts") {
+		t.Errorf("Down undid the wrong migration")
+	}
+
+	undone, err = m.Down(ctx, 5)
+	if err != nil || len(undone) != 1 {
+		t.Fatalf("Down failed: %v, %+v", err, undone)
+	}
+	if tableExists(t, db, "posts") {
+		t.Errorf("Migration 1 wasn't undone")
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	migrations, err := Load(fstest.MapFS{
+		"0001_init.up.sql":   {Data: []byte(`CREATE TABLE posts (id INTEGER PRIMARY KEY);`)},
+		"0002_broken.up.sql": {Data: []byte(`CREATE TABLE notes (id INTEGER); INSERT INTO missing VALUES (1);`)},
+	})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	m := New(db, SQLite, migrations)
+
+	applied, err := m.Up(ctx)
+	if err == nil {
+		t.Fatalf("Expected the broken migration to fail")
+	}
+	if len(applied) != 1 {
+		t.Errorf("Expected the first migration to be applied, got %+v", applied)
+	}
+	if tableExists(t, db, "notes") {
+		t.Errorf("Broken migration was not rolled back")
+	}
+
+	status, _ := m.Status(ctx)
+	if status[1].AppliedAt != nil {
+		t.Errorf("Broken migration was recorded as applied")
+	}
+
+	// migrations without a down file can't be undone
+	if _, err := m.Down(ctx, 1); err == nil {
+		t.Errorf("Expected Down to fail without a down file")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"bugmaschine/e6-cache/migrate"
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migrator returns the migrations for the database's dialect, from migrations/<dialect name>.
+func (d *sqlDB) Migrator() (*migrate.Migrator, error) {
+	files, err := fs.Sub(migrationFiles, "migrations/"+d.dialect.name)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := migrate.Load(files)
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(d.db, d.dialect.migrate, migrations), nil
+}
+
+// migrateOnStart brings the schema up to date, other instances wait while it's running.
+func migrateOnStart(d DB) {
+	migrator, err := d.Migrator()
+	if err != nil {
+		logging.Fatal("Failed to load migrations: %v", err)
+	}
+
+	applied, err := migrator.Up(context.Background())
+	for _, m := range applied {
+		logging.Info("Applied migration %d_%v", m.Version, m.Name)
+	}
+	if err != nil {
+		logging.Fatal("Failed to migrate the database: %v", err)
+	}
+}
+
+// migrateCommand handles "e6-cache migrate status|up|down [steps]".
+func migrateCommand(d DB, args []string) {
+	migrator, err := d.Migrator()
+	if err != nil {
+		logging.Fatal("Failed to load migrations: %v", err)
+	}
+	ctx := context.Background()
+
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			logging.Fatal("Failed to get migration status: %v", err)
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Nothing to do")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				logging.Fatal("Invalid number of steps %q", args[1])
+			}
+		}
+		undone, err := migrator.Down(ctx, steps)
+		for _, m := range undone {
+			fmt.Printf("Undid %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			logging.Fatal("%v", err)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, "Usage: e6-cache migrate status|up|down [steps]")
+		os.Exit(2)
+	}
+}
@@ -1,5 +1,5 @@
--- Create table
-CREATE TABLE posts (
+-- The original db.sql. Databases created with it already have most of this, so everything is IF NOT EXISTS.
+CREATE TABLE IF NOT EXISTS posts (
   id                 BIGINT          PRIMARY KEY,
   created_at         TIMESTAMP WITH TIME ZONE NOT NULL,
   updated_at         TIMESTAMP WITH TIME ZONE NOT NULL,
@@ -58,7 +58,9 @@ CREATE TABLE posts (
   UNIQUE (id)
 );
 
-CREATE TABLE pools (
+CREATE INDEX IF NOT EXISTS posts_file_md5_idx ON posts (file_md5);
+
+CREATE TABLE IF NOT EXISTS pools (
     id INTEGER PRIMARY KEY,
     name TEXT NOT NULL,
     created_at TIMESTAMP NOT NULL,
@@ -71,13 +73,13 @@ CREATE TABLE pools (
     post_count INTEGER
 );
 
-CREATE TABLE pool_posts (
+CREATE TABLE IF NOT EXISTS pool_posts (
     pool_id INTEGER NOT NULL REFERENCES pools(id) ON DELETE CASCADE,
     post_id INTEGER NOT NULL,
     PRIMARY KEY (pool_id, post_id)
 );
 
-CREATE TABLE comments (
+CREATE TABLE IF NOT EXISTS comments (
     id BIGINT PRIMARY KEY,
     created_at TIMESTAMPTZ NOT NULL,
     post_id BIGINT NOT NULL,
@@ -94,3 +96,15 @@ CREATE TABLE comments (
     creator_name TEXT NOT NULL,
     updater_name TEXT NOT NULL
 );
+
+CREATE TABLE IF NOT EXISTS post_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    post_id BIGINT NOT NULL,
+    recorded_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    old_change_seq BIGINT NOT NULL,
+    new_change_seq BIGINT NOT NULL,
+    changes JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS post_revisions_post_id_idx ON post_revisions (post_id);
@@ -0,0 +1,3 @@
+ALTER TABLE posts DROP COLUMN raw, DROP COLUMN fetched_at, DROP COLUMN source_url;
+ALTER TABLE pools DROP COLUMN raw, DROP COLUMN fetched_at, DROP COLUMN source_url;
+ALTER TABLE comments DROP COLUMN raw, DROP COLUMN fetched_at, DROP COLUMN source_url;
@@ -0,0 +1,16 @@
+-- The upstream JSON of everything we store, so fields e6-cache doesn't know about yet aren't lost.
+-- "e6-cache reindex" rebuilds the typed columns from it.
+ALTER TABLE posts
+  ADD COLUMN raw        JSONB,
+  ADD COLUMN fetched_at TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN source_url TEXT;
+
+ALTER TABLE pools
+  ADD COLUMN raw        JSONB,
+  ADD COLUMN fetched_at TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN source_url TEXT;
+
+ALTER TABLE comments
+  ADD COLUMN raw        JSONB,
+  ADD COLUMN fetched_at TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN source_url TEXT;
@@ -0,0 +1,11 @@
+-- Posts that vanished upstream: deleted, not found anymore, or with a hidden file url.
+CREATE TABLE post_tombstones (
+  post_id       BIGINT                   PRIMARY KEY,
+  reason        TEXT                     NOT NULL, -- deleted, not_found or file_hidden
+  first_seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  last_seen_at  TIMESTAMP WITH TIME ZONE NOT NULL,
+  restored_at   TIMESTAMP WITH TIME ZONE,          -- set once upstream has it again
+  last_state    JSONB                              -- the post as we knew it before it vanished
+);
+
+CREATE INDEX post_tombstones_first_seen_at_idx ON post_tombstones (first_seen_at);
@@ -0,0 +1 @@
+ALTER TABLE pool_posts DROP COLUMN position;
@@ -0,0 +1,3 @@
+-- Where a post is in its pool, pools are ordered (comics) and not by post ID.
+-- Pools saved before this keep the ID order until "e6-cache reindex pools" or their next fetch.
+ALTER TABLE pool_posts ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
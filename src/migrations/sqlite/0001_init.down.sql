@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS post_revisions;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS pool_posts;
+DROP TABLE IF EXISTS pools;
+DROP TABLE IF EXISTS posts;
@@ -0,0 +1,11 @@
+ALTER TABLE posts DROP COLUMN raw;
+ALTER TABLE posts DROP COLUMN fetched_at;
+ALTER TABLE posts DROP COLUMN source_url;
+
+ALTER TABLE pools DROP COLUMN raw;
+ALTER TABLE pools DROP COLUMN fetched_at;
+ALTER TABLE pools DROP COLUMN source_url;
+
+ALTER TABLE comments DROP COLUMN raw;
+ALTER TABLE comments DROP COLUMN fetched_at;
+ALTER TABLE comments DROP COLUMN source_url;
@@ -0,0 +1,13 @@
+-- The upstream JSON of everything we store, so fields e6-cache doesn't know about yet aren't lost.
+-- "e6-cache reindex" rebuilds the typed columns from it.
+ALTER TABLE posts ADD COLUMN raw TEXT;
+ALTER TABLE posts ADD COLUMN fetched_at TIMESTAMP;
+ALTER TABLE posts ADD COLUMN source_url TEXT;
+
+ALTER TABLE pools ADD COLUMN raw TEXT;
+ALTER TABLE pools ADD COLUMN fetched_at TIMESTAMP;
+ALTER TABLE pools ADD COLUMN source_url TEXT;
+
+ALTER TABLE comments ADD COLUMN raw TEXT;
+ALTER TABLE comments ADD COLUMN fetched_at TIMESTAMP;
+ALTER TABLE comments ADD COLUMN source_url TEXT;
@@ -0,0 +1,2 @@
+-- The video versions of a post (sample.alternates). Posts saved before this only get them with "e6-cache reindex posts".
+ALTER TABLE posts ADD COLUMN sample_alternates TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+DROP INDEX posts_fetched_at_idx;
+DROP TABLE post_refresh;
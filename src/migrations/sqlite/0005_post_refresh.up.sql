@@ -0,0 +1,10 @@
+-- Background refreshes of stale posts, see refresh.go
+CREATE TABLE post_refresh (
+    post_id INTEGER PRIMARY KEY,
+    pinned BOOLEAN NOT NULL DEFAULT FALSE, -- refreshed before everything else
+    last_attempt_at TIMESTAMP,
+    last_status TEXT, -- ok, missing or error
+    last_error TEXT
+);
+
+CREATE INDEX posts_fetched_at_idx ON posts (fetched_at);
@@ -0,0 +1,19 @@
+-- Background work that has to survive restarts: downloads, refreshes and archive runs. See jobs.go
+CREATE TABLE jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    dedup_key TEXT, -- only one queued or running job per key
+    priority INTEGER NOT NULL DEFAULT 0, -- higher runs first
+    state TEXT NOT NULL DEFAULT 'queued', -- queued, running or dead
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL,
+    run_at TIMESTAMP NOT NULL, -- not before this, pushed back after failures
+    locked_until TIMESTAMP, -- running jobs past this were abandoned and run again
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE UNIQUE INDEX jobs_dedup_key_idx ON jobs (dedup_key) WHERE state IN ('queued', 'running');
+CREATE INDEX jobs_next_idx ON jobs (state, priority DESC, run_at);
@@ -0,0 +1,15 @@
+-- Runs of "e6-cache archive" and /admin/archive, see archive.go
+CREATE TABLE archive_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    target TEXT NOT NULL, -- tag query, pool:<id>, set:<id> or fav:<user>
+    state TEXT NOT NULL, -- running or done
+    before_id INTEGER NOT NULL DEFAULT 0, -- the next page is below this post id, 0 before the first page
+    pages INTEGER NOT NULL DEFAULT 0,
+    posts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX archive_runs_target_idx ON archive_runs (target) WHERE state = 'running';
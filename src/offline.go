@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"bugmaschine/e6-cache/tagquery"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// offline modes, set with OFFLINE_MODE
+const (
+	offlineOff      = "off"      // always ask upstream, fail with 502 if it's down
+	offlineFallback = "fallback" // ask upstream, answer from the archive if it's down
+	offlineOnly     = "only"     // never ask upstream, answer everything from the archive
+)
+
+var (
+	offlinePostRegex = regexp.MustCompile(`^/posts/(\d+)\.json$`)
+	offlinePoolRegex = regexp.MustCompile(`^/pools/(\d+)\.json$`)
+
+	defaultPostLimit = 75  // same as e621
+	maxPostLimit     = 320 // same as e621
+)
+
+// canServeOffline reports if a request can be answered from the local archive.
+func canServeOffline(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet {
+		return false
+	}
+
+	path := c.Request.URL.Path
+	return path == "/posts.json" || offlinePostRegex.MatchString(path) || offlinePoolRegex.MatchString(path)
+}
+
+// isUpstreamDown reports if the upstream status code means the backend is unavailable, rather than the request being bad.
+func isUpstreamDown(statusCode int) bool {
+	// 501 is what e621 uses for rate limiting, which gets handled separately
+	return statusCode >= 500 && statusCode != http.StatusNotImplemented
+}
+
+// serveOffline answers a request from the local archive, the caller has to check canServeOffline first.
+func serveOffline(c *gin.Context) {
+	logging.Info("Serving %v from the local archive", c.Request.URL.Path)
+	c.Header("X-E6-Cache", "offline")
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	path := c.Request.URL.Path
+	switch {
+	case path == "/posts.json":
+		serveOfflinePosts(ctx, c)
+	case offlinePostRegex.MatchString(path):
+		id, _ := strconv.ParseInt(offlinePostRegex.FindStringSubmatch(path)[1], 10, 64)
+		serveOfflinePost(ctx, c, id)
+	case offlinePoolRegex.MatchString(path):
+		id, _ := strconv.ParseInt(offlinePoolRegex.FindStringSubmatch(path)[1], 10, 64)
+		serveOfflinePool(ctx, c, id)
+	default:
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Not available in offline mode", "ok": false})
+	}
+}
+
+func serveOfflinePosts(ctx context.Context, c *gin.Context) {
+	posts, err := searchArchive(ctx, c)
+	if err != nil {
+		if errors.Is(err, errInvalidSearch) {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "ok": false})
+			return
+		}
+		logging.Error("Error searching posts offline: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to search archive", "ok": false})
+		return
+	}
+
+	response := PostsResponse{Posts: make([]Post, 0, len(posts))}
+	for _, post := range posts {
+		rewritePostURLs(post, c.GetString(proxyUserKey))
+		response.Posts = append(response.Posts, *post)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+var errInvalidSearch = errors.New("invalid search")
+
+// searchArchive runs the tags, limit and page query parameters (same meaning as on /posts.json) against the archive.
+func searchArchive(ctx context.Context, c *gin.Context) ([]*Post, error) {
+	limit := defaultPostLimit
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, maxPostLimit)
+	}
+
+	q, err := tagquery.Parse(c.Query("tags"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSearch, err)
+	}
+
+	// page is either a page number, or b<id> / a<id> for posts before / after an id
+	offset := 0
+	after := false
+	page := c.Query("page")
+	switch {
+	case strings.HasPrefix(page, "b") || strings.HasPrefix(page, "a"):
+		id, err := strconv.ParseInt(page[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid page %q", errInvalidSearch, page)
+		}
+		r := &tagquery.Range{Op: "<", Max: id}
+		q.Order = tagquery.OrderIDDesc
+		if page[0] == 'a' {
+			// the posts right after id, not the newest ones. They get turned around below, like upstream sends them
+			after = true
+			r = &tagquery.Range{Op: ">", Min: id}
+			q.Order = tagquery.OrderIDAsc
+		}
+		q.Terms = append(q.Terms, tagquery.Term{Kind: tagquery.KindID, Range: r})
+	case page != "":
+		if p, err := strconv.Atoi(page); err == nil && p > 1 {
+			offset = (p - 1) * limit
+		}
+	}
+
+	posts, err := Database.SearchPosts(ctx, q, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	if after {
+		slices.Reverse(posts)
+	}
+	return posts, nil
+}
+
+func serveOfflinePost(ctx context.Context, c *gin.Context, id int64) {
+	post, err := Database.GetPost(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Post not found in archive", "ok": false})
+		return
+	}
+	if err != nil {
+		logging.Error("Error loading post %v offline: %v", id, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load post", "ok": false})
+		return
+	}
+
+	rewritePostURLs(post, c.GetString(proxyUserKey))
+	c.JSON(http.StatusOK, PostResponse{Post: *post})
+}
+
+func serveOfflinePool(ctx context.Context, c *gin.Context, id int64) {
+	pool, err := Database.GetPool(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Pool not found in archive", "ok": false})
+		return
+	}
+	if err != nil {
+		logging.Error("Error loading pool %v offline: %v", id, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load pool", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, pool)
+}
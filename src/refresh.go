@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The refresher asks upstream for posts we haven't seen in a while, so scores, tags and deletions stay current
+// even for posts nobody looks at anymore. It goes through the same upsert as posts from clients, so changes end up as revisions.
+
+const (
+	refreshOK      = "ok"
+	refreshMissing = "missing" // not in the search results anymore
+	refreshError   = "error"
+
+	maxRefreshBatchSize = 100 // ids e621 takes in one id: tag
+)
+
+var (
+	refreshInterval  time.Duration         // time between two batches, 0 disables refreshing. set with REFRESH_INTERVAL
+	refreshMaxAge    = 7 * 24 * time.Hour  // posts fetched longer ago get refreshed, set with REFRESH_MAX_AGE
+	refreshBatchSize = maxRefreshBatchSize // posts per request, set with REFRESH_BATCH_SIZE
+	refreshPinned    = false               // only refresh pinned and favorited posts, set with REFRESH_ONLY_PINNED
+
+	// started in main if refreshInterval is set
+	refresher *postRefresher
+)
+
+type postRefresher struct {
+	interval time.Duration
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+func startRefresher(interval time.Duration) *postRefresher {
+	r := &postRefresher{interval: interval, stopping: make(chan struct{}), done: make(chan struct{})}
+	go r.run()
+	return r
+}
+
+// run queues a batch every interval. Only one batch is queued at a time, so when upstream has trouble,
+// the job queue's backoff slows the refresher down too.
+func (r *postRefresher) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopping:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+		if err := queueRefresh(ctx); err != nil {
+			logging.Error("Error queueing stale posts for a refresh: %v", err)
+		}
+		cancel()
+	}
+}
+
+func (r *postRefresher) stop() {
+	close(r.stopping)
+	<-r.done
+}
+
+// refreshJob is the payload of a jobRefresh.
+type refreshJob struct {
+	Posts []StalePost `json:"posts"`
+}
+
+// queueRefresh submits the next batch of stale posts, unless the last one is still queued.
+func queueRefresh(ctx context.Context) error {
+	stale, err := Database.StalePosts(ctx, time.Now().Add(-refreshMaxAge), refreshPinned, refreshBatchSize)
+	if err != nil {
+		return err
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	job, err := newJob(jobRefresh, jobRefresh, jobPriorityRefresh, refreshJob{Posts: stale})
+	if err != nil {
+		return err
+	}
+	return submitJobs(ctx, []Job{job})
+}
+
+func runRefreshJob(ctx context.Context, payload json.RawMessage) error {
+	var job refreshJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return fmt.Errorf("%w: %v", errJobPermanent, err)
+	}
+	return refreshPosts(ctx, job.Posts)
+}
+
+// refreshPosts refreshes one batch of posts, and records how it went for each of them.
+func refreshPosts(ctx context.Context, stale []StalePost) error {
+	ids := make([]int64, len(stale))
+	for i, p := range stale {
+		ids[i] = p.ID
+	}
+
+	posts, err := fetchPostsByID(ctx, ids)
+	if err == nil {
+		// without auth upstream doesn't say, which shouldn't drop the favorites we know about
+		for _, p := range posts {
+			for _, s := range stale {
+				if p.IsFavorited == nil && int64(p.ID) == s.ID {
+					p.IsFavorited = s.Favorited
+				}
+			}
+		}
+		err = Database.UpsertPosts(ctx, posts)
+	}
+	metrics.Add("refresh_batches", 1)
+	if err != nil {
+		metrics.Add("refresh_errors", 1)
+		if recordErr := Database.RecordRefresh(ctx, ids, refreshError, err.Error()); recordErr != nil {
+			logging.Error("Error recording refresh of %d posts: %v", len(ids), recordErr)
+		}
+		return err
+	}
+
+	found := map[int64]bool{}
+	var refreshed, missing []int64
+	for _, p := range posts {
+		found[int64(p.ID)] = true
+	}
+	for _, id := range ids {
+		if found[id] {
+			refreshed = append(refreshed, id)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	if err := Database.RecordRefresh(ctx, refreshed, refreshOK, ""); err != nil {
+		return fmt.Errorf("recording refresh: %w", err)
+	}
+	if err := Database.RecordRefresh(ctx, missing, refreshMissing, ""); err != nil {
+		return fmt.Errorf("recording refresh: %w", err)
+	}
+	// the search includes deleted posts, so these are gone for good
+	for _, id := range missing {
+		if _, err := Database.TombstonePost(ctx, id, tombstoneNotFound); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			logging.Error("Error recording tombstone of post %v: %v", id, err)
+		}
+	}
+
+	metrics.Add("refresh_posts", int64(len(refreshed)))
+	metrics.Add("refresh_missing", int64(len(missing)))
+	logging.Debug("Refreshed %d posts, %d missing upstream", len(refreshed), len(missing))
+	return nil
+}
+
+// fetchPostsByID searches upstream for the given posts, deleted ones included.
+func fetchPostsByID(ctx context.Context, ids []int64) ([]*Post, error) {
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = strconv.FormatInt(id, 10)
+	}
+	query := url.Values{}
+	query.Set("tags", "id:"+strings.Join(list, ",")+" status:any")
+	query.Set("limit", strconv.Itoa(len(ids)))
+	return fetchPosts(ctx, query)
+}
+
+// refreshStatus shows when a post was last refreshed and how that went.
+func refreshStatus(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID", "ok": false})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	status, err := Database.RefreshStatus(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Post not found in archive", "ok": false})
+		return
+	}
+	if err != nil {
+		logging.Error("Error loading refresh status of post %v: %v", id, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load refresh status", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// pinPost (PUT) and unpinPost (DELETE) decide whether a post gets refreshed before everything else.
+func pinPost(c *gin.Context)   { setPinned(c, true) }
+func unpinPost(c *gin.Context) { setPinned(c, false) }
+
+func setPinned(c *gin.Context, pinned bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID", "ok": false})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	err = Database.PinPost(ctx, id, pinned)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Post not found in archive", "ok": false})
+		return
+	}
+	if err != nil {
+		logging.Error("Error pinning post %v: %v", id, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to pin post", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"post_id": id, "pinned": pinned, "ok": true})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeFetchedPost saves a post as if it was fetched at fetchedAt, zero for posts from before the archive.
+func storeFetchedPost(t *testing.T, d *sqlDB, id int, fetchedAt time.Time, favorited *bool) {
+	t.Helper()
+	post := &Post{ID: id, ChangeSeq: 1, CreatedAt: fetchedAt, IsFavorited: favorited}
+	post.FetchedAt = fetchedAt
+	upsert(t, d, post)
+}
+
+func staleIDs(t *testing.T, d *sqlDB, before time.Time, pinnedOnly bool, limit int) []int64 {
+	t.Helper()
+	stale, err := d.StalePosts(context.Background(), before, pinnedOnly, limit)
+	if err != nil {
+		t.Fatalf("StalePosts failed: %v", err)
+	}
+	ids := make([]int64, len(stale))
+	for i, p := range stale {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+func TestStalePosts(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+	now := time.Now()
+	old := now.Add(-10 * 24 * time.Hour)
+	before := now.Add(-7 * 24 * time.Hour)
+	favorited := true
+
+	storeFetchedPost(t, d, 1, now, nil)
+	storeFetchedPost(t, d, 2, old, nil)
+	storeFetchedPost(t, d, 3, time.Time{}, nil)
+	storeFetchedPost(t, d, 4, old, &favorited)
+	storeFetchedPost(t, d, 5, old, nil)
+	if err := d.PinPost(ctx, 5, true); err != nil {
+		t.Fatalf("PinPost failed: %v", err)
+	}
+
+	// pinned, favorited, never fetched, then the oldest
+	if ids := staleIDs(t, d, before, false, 10); !slices.Equal(ids, []int64{5, 4, 3, 2}) {
+		t.Errorf("Expected stale posts [5 4 3 2], got %v", ids)
+	}
+	if ids := staleIDs(t, d, before, false, 2); !slices.Equal(ids, []int64{5, 4}) {
+		t.Errorf("Expected the first 2 stale posts, got %v", ids)
+	}
+	if ids := staleIDs(t, d, before, true, 10); !slices.Equal(ids, []int64{5, 4}) {
+		t.Errorf("Expected only the pinned and favorited posts, got %v", ids)
+	}
+
+	stale, err := d.StalePosts(ctx, before, true, 10)
+	if err != nil {
+		t.Fatalf("StalePosts failed: %v", err)
+	}
+	if stale[0].Favorited != nil || stale[1].Favorited == nil || !*stale[1].Favorited {
+		t.Errorf("Expected is_favorited to be passed along, got %v and %v", stale[0].Favorited, stale[1].Favorited)
+	}
+
+	// tried recently, unless it failed
+	if err := d.RecordRefresh(ctx, []int64{2}, refreshMissing, ""); err != nil {
+		t.Fatalf("RecordRefresh failed: %v", err)
+	}
+	if err := d.RecordRefresh(ctx, []int64{3}, refreshError, "upstream is down"); err != nil {
+		t.Fatalf("RecordRefresh failed: %v", err)
+	}
+	if ids := staleIDs(t, d, before, false, 10); !slices.Equal(ids, []int64{5, 4, 3}) {
+		t.Errorf("Expected the failed post to stay stale and the missing one not, got %v", ids)
+	}
+
+	status, err := d.RefreshStatus(ctx, 3)
+	if err != nil {
+		t.Fatalf("RefreshStatus failed: %v", err)
+	}
+	if status.LastStatus != refreshError || status.LastError != "upstream is down" || status.LastAttemptAt == nil {
+		t.Errorf("Expected the failed refresh to be recorded, got %+v", status)
+	}
+}
+
+// fakeRefreshUpstream answers /posts.json with the posts in ids, anonymously (is_favorited null). A nil ids fails every request.
+func fakeRefreshUpstream(t *testing.T, ids []int) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Query().Get("tags"), "status:any") {
+			t.Errorf("Expected a search that includes deleted posts, got %q", r.URL.Query().Get("tags"))
+		}
+		if ids == nil {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		posts := make([]string, len(ids))
+		for i, id := range ids {
+			posts[i] = fmt.Sprintf(`{"id": %d, "change_seq": 2, "is_favorited": null}`, id)
+		}
+		fmt.Fprintf(w, `{"posts": [%s]}`, strings.Join(posts, ", "))
+	}))
+	t.Cleanup(server.Close)
+
+	oldBase := baseURL
+	t.Cleanup(func() { baseURL = oldBase })
+	baseURL = server.URL
+}
+
+func TestRefreshPosts(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	favorited := true
+
+	storeFetchedPost(t, d, 1, old, &favorited)
+	storeFetchedPost(t, d, 2, old, nil)
+	fakeRefreshUpstream(t, []int{1})
+
+	stale, err := d.StalePosts(ctx, time.Now(), false, 10)
+	if err != nil {
+		t.Fatalf("StalePosts failed: %v", err)
+	}
+	if err := refreshPosts(ctx, stale); err != nil {
+		t.Fatalf("refreshPosts failed: %v", err)
+	}
+
+	// anonymous refreshes don't know about favorites
+	post, err := d.GetPost(ctx, 1)
+	if err != nil {
+		t.Fatalf("GetPost failed: %v", err)
+	}
+	if post.ChangeSeq != 2 || post.IsFavorited == nil || !*post.IsFavorited {
+		t.Errorf("Expected the refreshed post to stay favorited, got change_seq %d, is_favorited %v", post.ChangeSeq, post.IsFavorited)
+	}
+	if status, err := d.RefreshStatus(ctx, 1); err != nil || status.LastStatus != refreshOK {
+		t.Errorf("Expected an ok refresh, got %+v: %v", status, err)
+	}
+
+	// the search includes deleted posts, so a missing one is gone
+	if status, err := d.RefreshStatus(ctx, 2); err != nil || status.LastStatus != refreshMissing {
+		t.Errorf("Expected a missing refresh, got %+v: %v", status, err)
+	}
+	if tombstone := loadTombstone(t, d, 2); tombstone == nil || tombstone.Reason != tombstoneNotFound {
+		t.Errorf("Expected a not_found tombstone for the missing post, got %+v", tombstone)
+	}
+	if tombstone := loadTombstone(t, d, 1); tombstone != nil {
+		t.Errorf("Expected no tombstone for the refreshed post, got %+v", tombstone)
+	}
+}
+
+func TestRefreshPostsUpstreamError(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+
+	storeFetchedPost(t, d, 1, time.Time{}, nil)
+	fakeRefreshUpstream(t, nil)
+
+	if err := refreshPosts(ctx, []StalePost{{ID: 1}}); err == nil {
+		t.Fatal("Expected refreshPosts to fail")
+	}
+	status, err := d.RefreshStatus(ctx, 1)
+	if err != nil {
+		t.Fatalf("RefreshStatus failed: %v", err)
+	}
+	if status.LastStatus != refreshError || status.LastError == "" {
+		t.Errorf("Expected the error to be recorded, got %+v", status)
+	}
+	if tombstone := loadTombstone(t, d, 1); tombstone != nil {
+		t.Errorf("Expected no tombstone when upstream failed, got %+v", tombstone)
+	}
+}
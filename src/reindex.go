@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+const reindexBatchSize = 500
+
+// reindexCommand handles "e6-cache reindex [posts|pools|comments]...".
+// It decodes the archived upstream JSON again and writes the typed columns, so new columns get filled in after a schema change.
+func reindexCommand(d DB, args []string) {
+	tables := args
+	if len(tables) == 0 {
+		tables = archiveTables
+	}
+	for _, table := range tables {
+		if !slices.Contains(archiveTables, table) {
+			fmt.Fprintln(os.Stderr, "Usage: e6-cache reindex [posts|pools|comments]...")
+			os.Exit(2)
+		}
+	}
+
+	ctx := context.Background()
+	for _, table := range tables {
+		done, skipped, err := reindexTable(ctx, d, table)
+		fmt.Printf("Reindexed %d %s, skipped %d\n", done, table, skipped)
+		if err != nil {
+			logging.Fatal("Failed to reindex %v: %v", table, err)
+		}
+	}
+}
+
+// reindexTable goes through all archived rows of a table in batches. Documents that don't decode anymore are skipped.
+func reindexTable(ctx context.Context, d DB, table string) (done, skipped int, err error) {
+	var afterID int64
+	for {
+		payloads, err := d.RawPayloads(ctx, table, afterID, reindexBatchSize)
+		if err != nil {
+			return done, skipped, err
+		}
+		if len(payloads) == 0 {
+			return done, skipped, nil
+		}
+		afterID = payloads[len(payloads)-1].ID
+
+		switch table {
+		case "posts":
+			var posts []*Post
+			for _, payload := range payloads {
+				var p Post
+				if !decodePayload(table, payload, &p) {
+					skipped++
+					continue
+				}
+				p.setFetched(payload.FetchedAt, payload.SourceURL)
+				posts = append(posts, &p)
+			}
+			if err := d.UpsertPosts(ctx, posts); err != nil {
+				return done, skipped, err
+			}
+			done += len(posts)
+
+		case "pools":
+			for _, payload := range payloads {
+				var p Pool
+				if !decodePayload(table, payload, &p) {
+					skipped++
+					continue
+				}
+				p.setFetched(payload.FetchedAt, payload.SourceURL)
+				if err := d.UpdatePool(ctx, &p); err != nil {
+					return done, skipped, err
+				}
+				done++
+			}
+
+		case "comments":
+			var comments []Comment
+			for _, payload := range payloads {
+				var c Comment
+				if !decodePayload(table, payload, &c) {
+					skipped++
+					continue
+				}
+				c.setFetched(payload.FetchedAt, payload.SourceURL)
+				comments = append(comments, c)
+			}
+			if err := d.SaveComments(comments); err != nil {
+				return done, skipped, err
+			}
+			done += len(comments)
+		}
+	}
+}
+
+func decodePayload(table string, payload RawPayload, v any) bool {
+	if err := json.Unmarshal(payload.Raw, v); err != nil {
+		logging.Warn("Skipping %v %d, its archived json doesn't decode: %v", table, payload.ID, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ListDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+type StringDiff struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// PostDiff is what changed between two versions of a post. Unchanged fields are left empty.
+type PostDiff struct {
+	Tags        map[string]ListDiff `json:"tags,omitempty"` // by category
+	Rating      *StringDiff         `json:"rating,omitempty"`
+	Sources     *ListDiff           `json:"sources,omitempty"`
+	MD5         *StringDiff         `json:"md5,omitempty"`
+	Description *StringDiff         `json:"description,omitempty"`
+}
+
+type PostRevision struct {
+	ID           int64     `json:"id"`
+	PostID       int64     `json:"post_id"`
+	RecordedAt   time.Time `json:"recorded_at"` // when we noticed the change
+	UpdatedAt    time.Time `json:"updated_at"`  // updated_at of the post after the change
+	OldChangeSeq int       `json:"old_change_seq"`
+	NewChangeSeq int       `json:"new_change_seq"`
+	Changes      PostDiff  `json:"changes"`
+	TagsBefore   Tags      `json:"tags_before"` // filled in by the history endpoint
+}
+
+func diffList(old, new []string) ListDiff {
+	var d ListDiff
+	for _, v := range new {
+		if !slices.Contains(old, v) {
+			d.Added = append(d.Added, v)
+		}
+	}
+	for _, v := range old {
+		if !slices.Contains(new, v) {
+			d.Removed = append(d.Removed, v)
+		}
+	}
+	return d
+}
+
+func (d ListDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// undo applies the diff in reverse, turning the new list back into the old one
+func (d ListDiff) undo(list []string) []string {
+	var result []string
+	for _, v := range list {
+		if !slices.Contains(d.Added, v) {
+			result = append(result, v)
+		}
+	}
+	return append(result, d.Removed...)
+}
+
+// tagCategories maps the category names to the fields of Tags
+func tagCategories(t *Tags) map[string]*[]string {
+	return map[string]*[]string{
+		"general":   &t.General,
+		"species":   &t.Species,
+		"character": &t.Character,
+		"artist":    &t.Artist,
+		"invalid":   &t.Invalid,
+		"lore":      &t.Lore,
+		"meta":      &t.Meta,
+	}
+}
+
+func diffPosts(old, new *Post) PostDiff {
+	var d PostDiff
+
+	oldTags := tagCategories(&old.Tags)
+	for category, newTags := range tagCategories(&new.Tags) {
+		if td := diffList(*oldTags[category], *newTags); !td.empty() {
+			if d.Tags == nil {
+				d.Tags = map[string]ListDiff{}
+			}
+			d.Tags[category] = td
+		}
+	}
+
+	if old.Rating != new.Rating {
+		d.Rating = &StringDiff{Old: old.Rating, New: new.Rating}
+	}
+	if sd := diffList(old.Sources, new.Sources); !sd.empty() {
+		d.Sources = &sd
+	}
+	if old.File.MD5 != new.File.MD5 {
+		d.MD5 = &StringDiff{Old: old.File.MD5, New: new.File.MD5}
+	}
+	if old.Description != new.Description {
+		d.Description = &StringDiff{Old: old.Description, New: new.Description}
+	}
+
+	return d
+}
+
+// postHistory lists the locally recorded revisions of a post, newest first.
+// Every revision includes the tags the post had right before it.
+func postHistory(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID", "ok": false})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	post, err := Database.GetPost(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Post not found in archive", "ok": false})
+		return
+	}
+	if err != nil {
+		logging.Error("Error loading post %v: %v", id, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load post", "ok": false})
+		return
+	}
+
+	revisions, err := Database.GetPostRevisions(ctx, id)
+	if err != nil {
+		logging.Error("Error loading revisions of post %v: %v", id, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load revisions", "ok": false})
+		return
+	}
+
+	// walk back from the current tags
+	tags := post.Tags
+	for i := range revisions {
+		categories := tagCategories(&tags)
+		for category, td := range revisions[i].Changes.Tags {
+			if list, ok := categories[category]; ok {
+				*list = td.undo(*list)
+			}
+		}
+		revisions[i].TagsBefore = tags
+	}
+
+	c.JSON(http.StatusOK, gin.H{"post_id": id, "tags": post.Tags, "revisions": revisions})
+}
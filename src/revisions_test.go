@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPostHistoryErrors(t *testing.T) {
+	d := openTestDB(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/posts/:id/revisions", postHistory)
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/posts/1/revisions", nil))
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a post we don't have, got %d", code)
+	}
+	// the database failing isn't a missing post
+	d.db.Close()
+	if code := get(); code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 when the database fails, got %d", code)
+	}
+}
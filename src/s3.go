@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bugmaschine/e6-cache/storage"
 	"bytes"
 	"context"
 	"errors"
@@ -50,6 +51,7 @@ func NewS3Service(ctx context.Context, region, endpoint, accessKey, secretKey, b
 	uploader := manager.NewUploader(s3Client, func(u *manager.Uploader) {
 		u.PartSize = 10 * 1024 * 1024 // 10MB Parts
 		u.Concurrency = 999999        // give me all the power! (i mean, threads)
+		u.LeavePartsOnError = false   // abort multipart uploads if the body fails, e.g. on a truncated download
 	})
 
 	downloader := manager.NewDownloader(s3Client, func(d *manager.Downloader) {
@@ -65,7 +67,7 @@ func NewS3Service(ctx context.Context, region, endpoint, accessKey, secretKey, b
 	}, nil
 }
 
-func (s *S3Service) UploadToS3(ctx context.Context, file io.Reader, filename string) error {
+func (s *S3Service) Put(ctx context.Context, file io.Reader, filename string) error {
 
 	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(s.bucketName),
@@ -95,7 +97,7 @@ func (s *S3Service) DownloadFromS3(ctx context.Context, filename string) (io.Rea
 }
 
 // the difference is that the file isn't downloaded first, hopefully this incerases speed a bit
-func (s *S3Service) StreamFromS3(ctx context.Context, filename string) (io.ReadCloser, error) {
+func (s *S3Service) Stream(ctx context.Context, filename string) (io.ReadCloser, error) {
 	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(filename),
@@ -107,6 +109,42 @@ func (s *S3Service) StreamFromS3(ctx context.Context, filename string) (io.ReadC
 	return out.Body, nil
 }
 
+func (s *S3Service) Stat(ctx context.Context, filename string) (info storage.ObjectInfo, exists bool, err error) {
+	headOutput, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(filename),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		var nf *types.NotFound
+
+		if errors.As(err, &nsk) || errors.As(err, &nf) {
+			return storage.ObjectInfo{}, false, nil
+		}
+
+		return storage.ObjectInfo{}, false, fmt.Errorf("failed to stat file '%s' in S3 bucket '%s': %w", filename, s.bucketName, err)
+	}
+
+	return storage.ObjectInfo{
+		Size:         aws.ToInt64(headOutput.ContentLength),
+		ETag:         aws.ToString(headOutput.ETag),
+		LastModified: aws.ToTime(headOutput.LastModified),
+	}, true, nil
+}
+
+func (s *S3Service) StreamRange(ctx context.Context, filename string, start, end int64) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(filename),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream range of file '%s': %w", filename, err)
+	}
+
+	return out.Body, nil
+}
+
 func (s *S3Service) GetContentLength(ctx context.Context, filename string) (int64, error) {
 	headOutput, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucketName),
@@ -118,7 +156,7 @@ func (s *S3Service) GetContentLength(ctx context.Context, filename string) (int6
 	return *headOutput.ContentLength, nil
 }
 
-func (s *S3Service) DoesFileExistInS3(ctx context.Context, filename string) (bool, error) {
+func (s *S3Service) Exists(ctx context.Context, filename string) (bool, error) {
 
 	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucketName),
@@ -140,3 +178,40 @@ func (s *S3Service) DoesFileExistInS3(ctx context.Context, filename string) (boo
 
 	return true, nil
 }
+
+func (s *S3Service) Delete(ctx context.Context, filename string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(filename),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete file '%s' from S3 bucket '%s': %w", filename, s.bucketName, err)
+	}
+	return nil
+}
+
+func (s *S3Service) List(ctx context.Context, prefix string, fn func(key string, info storage.ObjectInfo) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list S3 bucket '%s': %w", s.bucketName, err)
+		}
+
+		for _, obj := range page.Contents {
+			info := storage.ObjectInfo{
+				Size:         aws.ToInt64(obj.Size),
+				ETag:         aws.ToString(obj.ETag),
+				LastModified: aws.ToTime(obj.LastModified),
+			}
+			if err := fn(aws.ToString(obj.Key), info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
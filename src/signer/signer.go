@@ -1,18 +1,62 @@
 package signer
 
 import (
+	"bufio"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
 )
 
+// Key is a signing key. Retired keys still verify signatures until NotAfter, but are never used for signing.
+type Key struct {
+	ID       string
+	Secret   []byte
+	NotAfter time.Time // zero means forever
+}
+
 type Signer struct {
-	secret []byte
+	keys   map[string]Key
+	active string // ID of the key used for signing
 }
 
+// NewSigner creates a signer with a single key.
 func NewSigner(secret []byte) *Signer {
-	return &Signer{secret: secret}
+	s, _ := NewMultiKeySigner([]Key{{ID: "0", Secret: secret}})
+	return s
+}
+
+// NewMultiKeySigner creates a signer with several keys. The first key is used for signing, all of them for verifying.
+// The first key can't be expired.
+func NewMultiKeySigner(keys []Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	// links it signs would never verify
+	if active := keys[0]; !active.NotAfter.IsZero() && time.Now().After(active.NotAfter) {
+		return nil, fmt.Errorf("active key %q expired at %v, put a new key first", active.ID, active.NotAfter.Format(time.RFC3339))
+	}
+
+	s := &Signer{keys: make(map[string]Key, len(keys)), active: keys[0].ID}
+	for _, k := range keys {
+		if k.ID == "" || strings.ContainsAny(k.ID, ".:\n") {
+			return nil, fmt.Errorf("invalid key ID %q", k.ID)
+		}
+		if len(k.Secret) == 0 {
+			return nil, fmt.Errorf("key %q is empty", k.ID)
+		}
+		if _, exists := s.keys[k.ID]; exists {
+			return nil, fmt.Errorf("duplicate key ID %q", k.ID)
+		}
+		s.keys[k.ID] = k
+	}
+	return s, nil
 }
 
 func GenerateSecretKey() []byte {
@@ -24,22 +68,91 @@ func GenerateSecretKey() []byte {
 	return key
 }
 
-func (s *Signer) Sign(message string) string {
-	h := hmac.New(sha256.New, s.secret)
+// ParseKeys reads keys in the format "id:base64secret[:notAfter]", one per line or separated by commas.
+// notAfter is an RFC 3339 timestamp. Empty lines and lines starting with # are ignored.
+func ParseKeys(r io.Reader) ([]Key, error) {
+	var keys []Key
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		for _, entry := range strings.Split(scanner.Text(), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+
+			parts := strings.SplitN(entry, ":", 3)
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("invalid key entry, expected id:secret")
+			}
+
+			secret, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("key %q is not valid base64: %w", parts[0], err)
+			}
+
+			key := Key{ID: parts[0], Secret: secret}
+			if len(parts) == 3 {
+				key.NotAfter, err = time.Parse(time.RFC3339, parts[2])
+				if err != nil {
+					return nil, fmt.Errorf("key %q has an invalid expiry: %w", parts[0], err)
+				}
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, scanner.Err()
+}
+
+// LoadOrCreateKeyFile reads the keys from path. If the file doesn't exist, it gets created with a new random key.
+func LoadOrCreateKeyFile(path string) ([]Key, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		line := fmt.Sprintf("%s:%s\n", time.Now().UTC().Format("20060102"), base64.StdEncoding.EncodeToString(GenerateSecretKey()))
+		if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+			return nil, fmt.Errorf("failed to create key file: %w", err)
+		}
+		return ParseKeys(strings.NewReader(line))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseKeys(f)
+}
+
+func (s *Signer) mac(secret []byte, message string) []byte {
+	h := hmac.New(sha256.New, secret)
 	h.Write([]byte(message))
-	signature := h.Sum(nil)
-	return base64.URLEncoding.EncodeToString(signature)
+	return h.Sum(nil)
+}
+
+// Sign signs the message with the active key. The signature looks like "<key id>.<base64 hmac>".
+func (s *Signer) Sign(message string) string {
+	signature := s.mac(s.keys[s.active].Secret, message)
+	return s.active + "." + base64.URLEncoding.EncodeToString(signature)
 }
 
 func (s *Signer) Verify(message, signature string) bool {
-	sigDecoded, err := base64.URLEncoding.DecodeString(signature)
+	keyID, encoded, found := strings.Cut(signature, ".")
+	if !found {
+		return false
+	}
+
+	key, ok := s.keys[keyID]
+	if !ok {
+		return false // unknown or removed key
+	}
+	if !key.NotAfter.IsZero() && time.Now().After(key.NotAfter) {
+		return false // retired key past its grace period
+	}
+
+	sigDecoded, err := base64.URLEncoding.DecodeString(encoded)
 	if err != nil {
 		return false // invalid base64 input
 	}
 
-	h := hmac.New(sha256.New, s.secret)
-	h.Write([]byte(message))
-	expectedSig := h.Sum(nil)
-
-	return hmac.Equal(sigDecoded, expectedSig)
+	return hmac.Equal(sigDecoded, s.mac(key.Secret, message))
 }
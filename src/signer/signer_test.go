@@ -1,7 +1,11 @@
 package signer
 
 import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSigner(t *testing.T) {
@@ -24,3 +28,99 @@ func TestSigner(t *testing.T) {
 		t.Errorf("Valid signature verification failed")
 	}
 }
+
+func TestSignerRotation(t *testing.T) {
+	testData := "https://www.youtube.com/watch?v=dQw4w9WgXcQ"
+
+	oldKey := Key{ID: "old", Secret: GenerateSecretKey()}
+	oldSigner, err := NewMultiKeySigner([]Key{oldKey})
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	oldSignature := oldSigner.Sign(testData)
+
+	// rotate: new key signs, old key still verifies
+	newKey := Key{ID: "new", Secret: GenerateSecretKey()}
+	rotated, err := NewMultiKeySigner([]Key{newKey, oldKey})
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	if !rotated.Verify(testData, oldSignature) {
+		t.Errorf("Signature of the old key failed to verify after rotation")
+	}
+
+	newSignature := rotated.Sign(testData)
+	if !strings.HasPrefix(newSignature, "new.") {
+		t.Errorf("Expected the new key to sign, got %v", newSignature)
+	}
+	if oldSigner.Verify(testData, newSignature) {
+		t.Errorf("Signature of an unknown key passed verification")
+	}
+
+	// grace period is over
+	oldKey.NotAfter = time.Now().Add(-time.Minute)
+	retired, err := NewMultiKeySigner([]Key{newKey, oldKey})
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+	if retired.Verify(testData, oldSignature) {
+		t.Errorf("Signature of a retired key passed verification")
+	}
+	if !retired.Verify(testData, newSignature) {
+		t.Errorf("Signature of the active key failed to verify")
+	}
+
+	// an expired key can't sign
+	if _, err := NewMultiKeySigner([]Key{oldKey, newKey}); err == nil {
+		t.Errorf("Expected an expired active key to be rejected")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	input := "# comment\nb:" + base64.StdEncoding.EncodeToString([]byte("secret-b")) +
+		"\n\na:" + base64.StdEncoding.EncodeToString([]byte("secret-a")) + ":2025-01-01T00:00:00Z"
+
+	keys, err := ParseKeys(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Failed to parse keys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(keys))
+	}
+	if keys[0].ID != "b" || string(keys[0].Secret) != "secret-b" || !keys[0].NotAfter.IsZero() {
+		t.Errorf("First key parsed wrong: %+v", keys[0])
+	}
+	if keys[1].ID != "a" || string(keys[1].Secret) != "secret-a" || keys[1].NotAfter.Year() != 2025 {
+		t.Errorf("Second key parsed wrong: %+v", keys[1])
+	}
+
+	// comma separated, like in an environment variable
+	keys, err = ParseKeys(strings.NewReader("x:" + base64.StdEncoding.EncodeToString([]byte("1")) + ",y:" + base64.StdEncoding.EncodeToString([]byte("2"))))
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("Failed to parse comma separated keys: %v %+v", err, keys)
+	}
+
+	for _, invalid := range []string{"nosecret", "a:not base64!", "a:" + base64.StdEncoding.EncodeToString([]byte("1")) + ":tomorrow"} {
+		if _, err := ParseKeys(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestLoadOrCreateKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing.keys")
+
+	created, err := LoadOrCreateKeyFile(path)
+	if err != nil || len(created) != 1 {
+		t.Fatalf("Failed to create key file: %v %+v", err, created)
+	}
+
+	loaded, err := LoadOrCreateKeyFile(path)
+	if err != nil || len(loaded) != 1 {
+		t.Fatalf("Failed to load key file: %v %+v", err, loaded)
+	}
+	if loaded[0].ID != created[0].ID || string(loaded[0].Secret) != string(created[0].Secret) {
+		t.Errorf("Key changed between loads")
+	}
+}
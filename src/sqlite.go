@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/migrate"
+	"bugmaschine/e6-cache/tagquery"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+
+	_ "modernc.org/sqlite" // SQLite driver, pure Go so the binary stays static
+)
+
+var sqliteDialect = sqlDialect{
+	name:      "sqlite",
+	migrate:   migrate.SQLite,
+	array:     func(v any) any { return jsonArray{v} },
+	forUpdate: "", // there are no row locks, but transactions lock the whole database right away (_txlock=immediate)
+	batchSize: 5,  // binding gets slow quickly with many params, and there are no round trips to save anyway
+	search:    (*tagquery.Query).SQLite,
+}
+
+// newSQLiteDB opens (or creates) a SQLite database file, so e6-cache can run without PostgreSQL.
+func newSQLiteDB(path string) (DB, error) {
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(10000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Set("_txlock", "immediate")
+	params.Set("_time_format", "sqlite") // the default can't be parsed back for zones like -04:00, which is what e621 sends
+
+	dbConn, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err = dbConn.Ping(); err != nil {
+		return nil, err
+	}
+
+	return &sqlDB{db: dbConn, dialect: sqliteDialect}, nil
+}
+
+// jsonArray stores a slice as a JSON array, since SQLite has no array type.
+// Like pq.Array, it takes a slice for writing and a pointer to one for scanning.
+type jsonArray struct {
+	v any
+}
+
+func (a jsonArray) Value() (driver.Value, error) {
+	// nil slices would end up as null, which json_each doesn't like
+	if rv := reflect.ValueOf(a.v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		return "[]", nil
+	}
+
+	data, err := json.Marshal(a.v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (a jsonArray) Scan(src any) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), a.v)
+	case []byte:
+		return json.Unmarshal(src, a.v)
+	case nil:
+		return nil
+	default:
+		return fmt.Errorf("can't scan %T into a json array", src)
+	}
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// temp files start with this, no escaped key can (url.PathEscape always escapes %)
+const tempPrefix = "%tmp-"
+
+// Local keeps objects in a directory on disk.
+// Objects are spread over 256*256 directories by the hash of their key, so no directory gets too big:
+// root/ab/cd/<escaped key>
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) (*Local, error) {
+	if root == "" {
+		return nil, errors.New("no storage path set")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory '%s': %w", root, err)
+	}
+	return &Local{root: root}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	name := url.PathEscape(key)
+	if key == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid key '%s'", key)
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	shard := hex.EncodeToString(sum[:2])
+	return filepath.Join(l.root, shard[:2], shard[2:], name), nil
+}
+
+func (l *Local) Exists(ctx context.Context, key string) (bool, error) {
+	_, exists, err := l.Stat(ctx, key)
+	return exists, err
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (ObjectInfo, bool, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, false, err
+	}
+
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, false, nil
+	}
+	if err != nil {
+		return ObjectInfo{}, false, fmt.Errorf("failed to stat file '%s': %w", key, err)
+	}
+	return fileInfo(fi), true, nil
+}
+
+func fileInfo(fi fs.FileInfo) ObjectInfo {
+	// files are never changed after they are written, so this is good enough as an etag
+	return ObjectInfo{
+		Size:         fi.Size(),
+		ETag:         fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()),
+		LastModified: fi.ModTime(),
+	}
+}
+
+func (l *Local) open(key string) (*os.File, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open file '%s': %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file '%s': %w", key, err)
+	}
+	return f, nil
+}
+
+func (l *Local) Stream(ctx context.Context, key string) (io.ReadCloser, error) {
+	return l.open(key)
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+func (l *Local) StreamRange(ctx context.Context, key string, start, end int64) (io.ReadCloser, error) {
+	f, err := l.open(key)
+	if err != nil {
+		return nil, err
+	}
+	return sectionReadCloser{io.NewSectionReader(f, start, end-start+1), f}, nil
+}
+
+// Put writes to a temp file next to the object and renames it once it's complete, so readers never see half a file.
+func (l *Local) Put(ctx context.Context, r io.Reader, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for '%s': %w", key, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for '%s': %w", key, err)
+	}
+	// does nothing once the rename went through
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file '%s': %w", key, err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to write file '%s': %w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("failed to write file '%s': %w", key, err)
+	}
+	return nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete file '%s': %w", key, err)
+	}
+	return nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string, fn func(key string, info ObjectInfo) error) error {
+	return filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+
+		key, err := url.PathUnescape(d.Name())
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			// not ours
+			return nil
+		}
+
+		fi, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted while listing
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(key, fileInfo(fi))
+	})
+}
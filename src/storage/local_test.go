@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newLocal(t *testing.T) *Local {
+	t.Helper()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal failed: %v", err)
+	}
+	return l
+}
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	l := newLocal(t)
+	key := "ab/cd/abcdef0123456789abcdef0123456789.png"
+
+	if exists, err := l.Exists(ctx, key); err != nil || exists {
+		t.Fatalf("Expected no object yet, got %v, %v", exists, err)
+	}
+	if _, err := l.Stream(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if err := l.Put(ctx, strings.NewReader("0123456789"), key); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	info, exists, err := l.Stat(ctx, key)
+	if err != nil || !exists {
+		t.Fatalf("Expected the object to exist, got %v, %v", exists, err)
+	}
+	if info.Size != 10 || info.ETag == "" || info.LastModified.IsZero() {
+		t.Errorf("Unexpected info: %+v", info)
+	}
+
+	body, err := l.Stream(ctx, key)
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "0123456789" {
+		t.Errorf("Unexpected content: %q", data)
+	}
+
+	body, err = l.StreamRange(ctx, key, 2, 4)
+	if err != nil {
+		t.Fatalf("StreamRange failed: %v", err)
+	}
+	data, _ = io.ReadAll(body)
+	body.Close()
+	if string(data) != "234" {
+		t.Errorf("Unexpected range: %q", data)
+	}
+
+	if err := l.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if exists, _ := l.Exists(ctx, key); exists {
+		t.Errorf("Object still exists after Delete")
+	}
+	if err := l.Delete(ctx, key); err != nil {
+		t.Errorf("Deleting a missing object should not fail: %v", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestLocalPutIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	l := newLocal(t)
+	key := "a.png"
+
+	if err := l.Put(ctx, strings.NewReader("old"), key); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// a failed write leaves the old object alone and no temp files behind
+	if err := l.Put(ctx, io.MultiReader(strings.NewReader("half"), failingReader{}), key); err == nil {
+		t.Fatalf("Expected Put to fail")
+	}
+
+	body, err := l.Stream(ctx, key)
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "old" {
+		t.Errorf("Expected the old content, got %q", data)
+	}
+
+	files := 0
+	filepath.WalkDir(l.root, func(p string, d os.DirEntry, err error) error {
+		if !d.IsDir() {
+			files++
+		}
+		return nil
+	})
+	if files != 1 {
+		t.Errorf("Expected 1 file, got %d", files)
+	}
+}
+
+func TestLocalList(t *testing.T) {
+	ctx := context.Background()
+	l := newLocal(t)
+
+	keys := []string{"ab/cd/1.png", "ab/cd/2.png", "ab/ef/3.png", "sample/4.jpg"}
+	for _, key := range keys {
+		if err := l.Put(ctx, strings.NewReader(key), key); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	var listed []string
+	err := l.List(ctx, "ab/", func(key string, info ObjectInfo) error {
+		if info.Size != int64(len(key)) {
+			t.Errorf("Unexpected size for %v: %d", key, info.Size)
+		}
+		listed = append(listed, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	slices.Sort(listed)
+	if !slices.Equal(listed, keys[:3]) {
+		t.Errorf("Unexpected keys: %v", listed)
+	}
+
+	// errors from fn stop the listing
+	stop := errors.New("stop")
+	calls := 0
+	err = l.List(ctx, "", func(key string, info ObjectInfo) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected List to stop after the first error, got %v after %d calls", err, calls)
+	}
+}
+
+func TestLocalInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	l := newLocal(t)
+
+	for _, key := range []string{"", ".", ".."} {
+		if err := l.Put(ctx, strings.NewReader("x"), key); err == nil {
+			t.Errorf("Expected Put(%q) to fail", key)
+		}
+	}
+
+	// slashes are escaped, so keys can't leave their directory
+	if err := l.Put(ctx, strings.NewReader("x"), "../../escape"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(l.root), "escape")); err == nil {
+		t.Errorf("Key escaped the storage directory")
+	}
+}
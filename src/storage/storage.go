@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo is the metadata of an object, as needed for conditional requests.
+type ObjectInfo struct {
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// Storage is where media files are kept, e.g. an S3 bucket or a local directory.
+type Storage interface {
+	Exists(ctx context.Context, key string) (bool, error)
+	// Stat returns the metadata of an object. exists is false if there is no such object.
+	Stat(ctx context.Context, key string) (info ObjectInfo, exists bool, err error)
+	Stream(ctx context.Context, key string) (io.ReadCloser, error)
+	// StreamRange streams the bytes from start to end (inclusive) of an object.
+	StreamRange(ctx context.Context, key string, start, end int64) (io.ReadCloser, error)
+	// Put stores everything r delivers under key. If r fails, nothing is stored.
+	Put(ctx context.Context, r io.Reader, key string) error
+	// Delete removes an object, deleting one that doesn't exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every object whose key starts with prefix, until fn returns an error.
+	List(ctx context.Context, prefix string, fn func(key string, info ObjectInfo) error) error
+}
@@ -0,0 +1,187 @@
+package tagquery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SQL is a compiled query, meant to be used as "SELECT ... FROM posts WHERE <Where> ORDER BY <OrderBy>".
+type SQL struct {
+	Where   string
+	Args    []any
+	OrderBy string
+}
+
+// dialect has everything that differs between databases
+type dialect struct {
+	param   func(n int) string
+	hasTag  func(param string) string // post has exactly this tag
+	likeTag func(param string) string // post has a tag matching this LIKE pattern
+}
+
+// all seven tag columns as one array
+const postgresAllTags = "(tags_general || tags_species || tags_character || tags_artist || tags_invalid || tags_lore || tags_meta)"
+
+var postgres = dialect{
+	param: func(n int) string {
+		return fmt.Sprintf("$%d", n)
+	},
+	hasTag: func(param string) string {
+		return param + " = ANY" + postgresAllTags
+	},
+	likeTag: func(param string) string {
+		return "EXISTS (SELECT 1 FROM unnest" + postgresAllTags + " AS tag WHERE tag LIKE " + param + ` ESCAPE '\')`
+	},
+}
+
+// SQLite has no arrays, the tag columns are JSON arrays there. This is all their tags as one column called value.
+const sqliteAllTags = "(SELECT value FROM json_each(tags_general) UNION ALL SELECT value FROM json_each(tags_species)" +
+	" UNION ALL SELECT value FROM json_each(tags_character) UNION ALL SELECT value FROM json_each(tags_artist)" +
+	" UNION ALL SELECT value FROM json_each(tags_invalid) UNION ALL SELECT value FROM json_each(tags_lore)" +
+	" UNION ALL SELECT value FROM json_each(tags_meta))"
+
+var sqlite = dialect{
+	param: postgres.param, // SQLite understands $1 too
+	hasTag: func(param string) string {
+		return param + " IN " + sqliteAllTags
+	},
+	likeTag: func(param string) string {
+		// LIKE ignores case for ASCII in SQLite, which doesn't matter since tags are lowercase anyway
+		return "EXISTS (SELECT 1 FROM " + sqliteAllTags + " WHERE value LIKE " + param + ` ESCAPE '\')`
+	},
+}
+
+var numericColumns = map[Kind]string{
+	KindScore:    "score_total",
+	KindFavCount: "fav_count",
+	KindID:       "id",
+	KindWidth:    "file_width",
+	KindHeight:   "file_height",
+}
+
+var orderClauses = map[Order]string{
+	OrderIDDesc:    "id DESC",
+	OrderIDAsc:     "id ASC",
+	OrderScoreDesc: "score_total DESC, id DESC",
+	OrderScoreAsc:  "score_total ASC, id DESC",
+	OrderFavDesc:   "fav_count DESC, id DESC",
+	OrderFavAsc:    "fav_count ASC, id DESC",
+	OrderRandom:    "random()",
+}
+
+// Postgres compiles the query for PostgreSQL, numbering the parameters starting at firstParam.
+func (q *Query) Postgres(firstParam int) SQL {
+	return q.compile(postgres, firstParam)
+}
+
+// SQLite compiles the query for SQLite, where the tag columns are JSON arrays.
+func (q *Query) SQLite(firstParam int) SQL {
+	return q.compile(sqlite, firstParam)
+}
+
+type compiler struct {
+	dialect dialect
+	next    int
+	args    []any
+}
+
+func (c *compiler) arg(v any) string {
+	c.args = append(c.args, v)
+	p := c.dialect.param(c.next)
+	c.next++
+	return p
+}
+
+func (q *Query) compile(d dialect, firstParam int) SQL {
+	c := &compiler{dialect: d, next: firstParam}
+
+	var and, or []string
+	for _, term := range q.Terms {
+		cond := c.condition(term)
+		if term.Negated {
+			cond = "NOT (" + cond + ")"
+		}
+		if term.Or {
+			or = append(or, cond)
+		} else {
+			and = append(and, cond)
+		}
+	}
+
+	if len(or) > 0 {
+		and = append(and, "("+strings.Join(or, " OR ")+")")
+	}
+
+	if !q.IncludesDeleted() {
+		and = append(and, "flags_deleted = FALSE")
+	}
+
+	if len(and) == 0 {
+		and = append(and, "TRUE")
+	}
+
+	order, ok := orderClauses[q.Order]
+	if !ok {
+		order = orderClauses[OrderIDDesc]
+	}
+
+	return SQL{
+		Where:   strings.Join(and, " AND "),
+		Args:    c.args,
+		OrderBy: order,
+	}
+}
+
+func (c *compiler) condition(t Term) string {
+	switch t.Kind {
+	case KindRating:
+		return "rating = " + c.arg(t.Value)
+	case KindType:
+		return "file_ext = " + c.arg(t.Value)
+	case KindStatus:
+		switch t.Value {
+		case "active":
+			return "(flags_deleted = FALSE AND flags_pending = FALSE)"
+		case "pending":
+			return "flags_pending = TRUE"
+		case "flagged":
+			return "flags_flagged = TRUE"
+		case "deleted":
+			return "flags_deleted = TRUE"
+		default: // any
+			return "TRUE"
+		}
+	case KindScore, KindFavCount, KindID, KindWidth, KindHeight:
+		return c.rangeCondition(numericColumns[t.Kind], t.Range)
+	default:
+		if strings.Contains(t.Value, "*") {
+			return c.dialect.likeTag(c.arg(likePattern(t.Value)))
+		}
+		return c.dialect.hasTag(c.arg(t.Value))
+	}
+}
+
+func (c *compiler) rangeCondition(column string, r *Range) string {
+	switch r.Op {
+	case "..":
+		return column + " BETWEEN " + c.arg(r.Min) + " AND " + c.arg(r.Max)
+	case "in":
+		params := make([]string, len(r.Values))
+		for i, v := range r.Values {
+			params[i] = c.arg(v)
+		}
+		return column + " IN (" + strings.Join(params, ", ") + ")"
+	case ">", ">=":
+		return column + " " + r.Op + " " + c.arg(r.Min)
+	case "<", "<=":
+		return column + " " + r.Op + " " + c.arg(r.Max)
+	default: // =
+		return column + " = " + c.arg(r.Min)
+	}
+}
+
+// likePattern turns a tag with * wildcards into a LIKE pattern, escaping everything else.
+func likePattern(tag string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `*`, `%`)
+	return replacer.Replace(tag)
+}
@@ -0,0 +1,134 @@
+package tagquery
+
+import (
+	"database/sql"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+type testPost struct {
+	id       int
+	rating   string
+	score    int
+	deleted  bool
+	general  []string
+	species  []string
+	artist   []string
+	fileType string
+}
+
+var testPosts = []testPost{
+	{1, "s", 10, false, []string{"solo"}, []string{"wolf"}, []string{"artist_a"}, "png"},
+	{2, "e", 50, false, []string{"duo"}, []string{"fox", "wolf"}, nil, "jpg"},
+	{3, "q", -5, false, []string{"solo", "canine_tooth"}, []string{"fox"}, []string{"artist_b"}, "webm"},
+	{4, "s", 20, true, []string{"solo"}, []string{"wolf"}, nil, "png"},
+	{5, "s", 30, false, []string{"100%_cute"}, []string{"canine"}, nil, "png"},
+}
+
+// openTestDB creates an in-memory SQLite database with the columns the compiled queries use.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	db.SetMaxOpenConns(1) // every connection would get its own in-memory database
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`CREATE TABLE posts (
+		id INTEGER PRIMARY KEY, rating TEXT, file_ext TEXT, score_total INTEGER, fav_count INTEGER,
+		file_width INTEGER, file_height INTEGER,
+		flags_deleted BOOLEAN, flags_pending BOOLEAN, flags_flagged BOOLEAN,
+		tags_general TEXT, tags_species TEXT, tags_character TEXT, tags_artist TEXT,
+		tags_invalid TEXT, tags_lore TEXT, tags_meta TEXT
+	)`)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	toJSON := func(tags []string) string {
+		if tags == nil {
+			return "[]"
+		}
+		data, _ := json.Marshal(tags)
+		return string(data)
+	}
+
+	for _, p := range testPosts {
+		_, err := db.Exec(`INSERT INTO posts VALUES ($1, $2, $3, $4, 0, 100, 100, $5, FALSE, FALSE, $6, $7, '[]', $8, '[]', '[]', '[]')`,
+			p.id, p.rating, p.fileType, p.score, p.deleted, toJSON(p.general), toJSON(p.species), toJSON(p.artist))
+		if err != nil {
+			t.Fatalf("Failed to insert post: %v", err)
+		}
+	}
+	return db
+}
+
+func searchIDs(t *testing.T, db *sql.DB, query string) []int {
+	t.Helper()
+	q, err := Parse(query)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %v", query, err)
+	}
+
+	compiled := q.SQLite(1)
+	rows, err := db.Query("SELECT id FROM posts WHERE "+compiled.Where+" ORDER BY "+compiled.OrderBy, compiled.Args...)
+	if err != nil {
+		t.Fatalf("Query %q failed: %v\n%s", query, err, compiled.Where)
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestSQLite(t *testing.T) {
+	db := openTestDB(t)
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{5, 3, 2, 1}},
+		{"wolf", []int{2, 1}},
+		{"wolf solo", []int{1}},
+		{"-wolf", []int{5, 3}},
+		{"~duo ~artist_b", []int{3, 2}},
+		{"canine*", []int{5, 3}},
+		{"100%*", []int{5}}, // % is not a wildcard
+		{"*_a", []int{1}},
+		{"rating:s", []int{5, 1}},
+		{"score:>=20", []int{5, 2}},
+		{"score:10..30 order:score", []int{5, 1}},
+		{"id:1,3,4", []int{3, 1}},
+		{"type:png status:deleted", []int{4}},
+		{"status:any wolf order:id_asc", []int{1, 2, 4}},
+	}
+
+	for _, tt := range tests {
+		if got := searchIDs(t, db, tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("Search %q = %v, expected %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// every fixture has to compile to something SQLite accepts
+func TestSQLiteFixtures(t *testing.T) {
+	db := openTestDB(t)
+	for _, f := range loadFixtures(t) {
+		if f.Error {
+			continue
+		}
+		searchIDs(t, db, f.Query)
+	}
+}
@@ -0,0 +1,226 @@
+// Package tagquery parses e621 style tag searches (the tags= parameter of /posts.json)
+// and compiles them to SQL for the posts table.
+package tagquery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Kind string
+
+const (
+	KindTag      Kind = "tag"
+	KindRating   Kind = "rating"
+	KindScore    Kind = "score"
+	KindFavCount Kind = "favcount"
+	KindID       Kind = "id"
+	KindWidth    Kind = "width"
+	KindHeight   Kind = "height"
+	KindType     Kind = "type"
+	KindStatus   Kind = "status"
+)
+
+type Order string
+
+const (
+	OrderIDDesc    Order = "id_desc" // default, newest first
+	OrderIDAsc     Order = "id_asc"
+	OrderScoreDesc Order = "score_desc"
+	OrderScoreAsc  Order = "score_asc"
+	OrderFavDesc   Order = "favcount_desc"
+	OrderFavAsc    Order = "favcount_asc"
+	OrderRandom    Order = "random"
+)
+
+// Range is a numeric condition like score:>=10, id:5..10 or id:1,2,3
+type Range struct {
+	Op     string  `json:"op"` // =, <, <=, >, >=, .. or in
+	Min    int64   `json:"min,omitempty"`
+	Max    int64   `json:"max,omitempty"`
+	Values []int64 `json:"values,omitempty"` // only for "in"
+}
+
+// Term is a single word of the query.
+type Term struct {
+	Kind    Kind   `json:"kind"`
+	Negated bool   `json:"negated,omitempty"` // -tag
+	Or      bool   `json:"or,omitempty"`      // ~tag
+	Value   string `json:"value,omitempty"`   // tag name (may contain * wildcards), rating letter, file type or status
+	Range   *Range `json:"range,omitempty"`
+}
+
+type Query struct {
+	Terms []Term `json:"terms"`
+	Order Order  `json:"order"`
+}
+
+var (
+	ratings = map[string]string{
+		"s": "s", "safe": "s",
+		"q": "q", "questionable": "q",
+		"e": "e", "explicit": "e",
+	}
+
+	statuses = []string{"active", "pending", "flagged", "deleted", "any"}
+
+	orders = map[string]Order{
+		"id": OrderIDAsc, "id_asc": OrderIDAsc, "id_desc": OrderIDDesc,
+		"score": OrderScoreDesc, "score_desc": OrderScoreDesc, "score_asc": OrderScoreAsc,
+		"favcount": OrderFavDesc, "favcount_desc": OrderFavDesc, "favcount_asc": OrderFavAsc,
+		"random": OrderRandom,
+	}
+
+	numericKinds = map[string]Kind{
+		"score": KindScore, "favcount": KindFavCount, "id": KindID, "width": KindWidth, "height": KindHeight,
+	}
+)
+
+// Parse parses an e621 tag query. Unknown metatags are treated as normal tags, because there are real tags with colons in them.
+func Parse(query string) (*Query, error) {
+	q := &Query{Order: OrderIDDesc}
+
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		term := Term{}
+
+		switch {
+		case strings.HasPrefix(word, "-") && len(word) > 1:
+			term.Negated = true
+			word = word[1:]
+		case strings.HasPrefix(word, "~") && len(word) > 1:
+			term.Or = true
+			word = word[1:]
+		}
+
+		name, value, isMeta := strings.Cut(word, ":")
+		if !isMeta || value == "" {
+			term.Kind = KindTag
+			term.Value = word
+			q.Terms = append(q.Terms, term)
+			continue
+		}
+
+		switch name {
+		case "order":
+			order, ok := orders[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown order %q", value)
+			}
+			q.Order = order
+			continue
+
+		case "rating":
+			rating, ok := ratings[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown rating %q", value)
+			}
+			term.Kind = KindRating
+			term.Value = rating
+
+		case "type":
+			term.Kind = KindType
+			term.Value = value
+
+		case "status":
+			found := false
+			for _, status := range statuses {
+				found = found || status == value
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown status %q", value)
+			}
+			term.Kind = KindStatus
+			term.Value = value
+
+		case "score", "favcount", "id", "width", "height":
+			r, err := parseRange(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			term.Kind = numericKinds[name]
+			term.Range = r
+
+		default:
+			term.Kind = KindTag
+			term.Value = word
+		}
+
+		q.Terms = append(q.Terms, term)
+	}
+
+	return q, nil
+}
+
+// parseRange parses the value of a numeric metatag, like >=10, 5..10, ..10, 10.., 1,2,3 or 7
+func parseRange(value string) (*Range, error) {
+	for _, op := range []string{">=", "<=", ">", "<"} { // the two character ones have to come first
+		if rest, ok := strings.CutPrefix(value, op); ok {
+			n, err := strconv.ParseInt(rest, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", rest)
+			}
+			if op == ">=" || op == ">" {
+				return &Range{Op: op, Min: n}, nil
+			}
+			return &Range{Op: op, Max: n}, nil
+		}
+	}
+
+	if lower, upper, ok := strings.Cut(value, ".."); ok {
+		switch {
+		case lower == "" && upper == "":
+			return nil, fmt.Errorf("empty range")
+		case lower == "":
+			n, err := strconv.ParseInt(upper, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", upper)
+			}
+			return &Range{Op: "<=", Max: n}, nil
+		case upper == "":
+			n, err := strconv.ParseInt(lower, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", lower)
+			}
+			return &Range{Op: ">=", Min: n}, nil
+		}
+
+		lo, err := strconv.ParseInt(lower, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", lower)
+		}
+		hi, err := strconv.ParseInt(upper, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", upper)
+		}
+		return &Range{Op: "..", Min: lo, Max: hi}, nil
+	}
+
+	if strings.Contains(value, ",") {
+		r := &Range{Op: "in"}
+		for _, part := range strings.Split(value, ",") {
+			n, err := strconv.ParseInt(part, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", part)
+			}
+			r.Values = append(r.Values, n)
+		}
+		return r, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a number", value)
+	}
+	return &Range{Op: "=", Min: n, Max: n}, nil
+}
+
+// IncludesDeleted reports if the query asks for deleted posts, which are hidden by default (same as on e621).
+func (q *Query) IncludesDeleted() bool {
+	for _, t := range q.Terms {
+		if t.Kind == KindStatus && !t.Negated && (t.Value == "deleted" || t.Value == "any") {
+			return true
+		}
+	}
+	return false
+}
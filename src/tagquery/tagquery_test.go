@@ -0,0 +1,107 @@
+package tagquery
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+type fixture struct {
+	Name    string          `json:"name"`
+	Query   string          `json:"query"`
+	Error   bool            `json:"error"`
+	Parsed  json.RawMessage `json:"parsed"`
+	Where   string          `json:"where"`
+	Args    json.RawMessage `json:"args"`
+	OrderBy string          `json:"order_by"`
+}
+
+func loadFixtures(t *testing.T) []fixture {
+	data, err := os.ReadFile("testdata/queries.json")
+	if err != nil {
+		t.Fatalf("Failed to read fixtures: %v", err)
+	}
+
+	var fixtures []fixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatalf("Failed to parse fixtures: %v", err)
+	}
+	return fixtures
+}
+
+// sameJSON compares two json documents, ignoring formatting
+func sameJSON(t *testing.T, a, b []byte) bool {
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("Invalid json %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("Invalid json %s: %v", b, err)
+	}
+	ca, _ := json.Marshal(va)
+	cb, _ := json.Marshal(vb)
+	return string(ca) == string(cb)
+}
+
+func TestParse(t *testing.T) {
+	for _, f := range loadFixtures(t) {
+		t.Run(f.Name, func(t *testing.T) {
+			q, err := Parse(f.Query)
+			if f.Error {
+				if err == nil {
+					t.Fatalf("Expected an error for %q, got %+v", f.Query, q)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse %q: %v", f.Query, err)
+			}
+
+			got, _ := json.Marshal(q)
+			if !sameJSON(t, got, f.Parsed) {
+				t.Errorf("Parse mismatch for %q.\nExpected: %s\nGot: %s", f.Query, f.Parsed, got)
+			}
+		})
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	for _, f := range loadFixtures(t) {
+		if f.Error {
+			continue
+		}
+
+		t.Run(f.Name, func(t *testing.T) {
+			q, err := Parse(f.Query)
+			if err != nil {
+				t.Fatalf("Failed to parse %q: %v", f.Query, err)
+			}
+
+			compiled := q.Postgres(1)
+			if compiled.Where != f.Where {
+				t.Errorf("Where mismatch for %q.\nExpected: %s\nGot: %s", f.Query, f.Where, compiled.Where)
+			}
+			if compiled.OrderBy != f.OrderBy {
+				t.Errorf("Order mismatch for %q.\nExpected: %s\nGot: %s", f.Query, f.OrderBy, compiled.OrderBy)
+			}
+
+			args, _ := json.Marshal(compiled.Args)
+			if !sameJSON(t, args, f.Args) {
+				t.Errorf("Args mismatch for %q.\nExpected: %s\nGot: %s", f.Query, f.Args, args)
+			}
+		})
+	}
+}
+
+func TestPostgresParamOffset(t *testing.T) {
+	q, err := Parse("wolf score:10..20")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	compiled := q.Postgres(4)
+	expected := "$4 = ANY(tags_general || tags_species || tags_character || tags_artist || tags_invalid || tags_lore || tags_meta) AND score_total BETWEEN $5 AND $6 AND flags_deleted = FALSE"
+	if compiled.Where != expected {
+		t.Errorf("Where mismatch.\nExpected: %s\nGot: %s", expected, compiled.Where)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/jsonrewrite"
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// why a post has a tombstone
+const (
+	tombstoneDeleted    = "deleted"     // flags.deleted
+	tombstoneNotFound   = "not_found"   // /posts/{id}.json answered 404, or a refresh didn't find it
+	tombstoneFileHidden = "file_hidden" // file.url is null, see hidden.go
+)
+
+// Tombstone records that a post vanished upstream. The archive keeps the post and its files,
+// which are served to users that HIDDEN_FILES allows.
+type Tombstone struct {
+	PostID      int64           `json:"post_id"`
+	Reason      string          `json:"reason"`
+	FirstSeenAt time.Time       `json:"first_seen_at"` // when we first noticed
+	LastSeenAt  time.Time       `json:"last_seen_at"`  // when we last noticed
+	RestoredAt  *time.Time      `json:"restored_at,omitempty"`
+	LastState   json.RawMessage `json:"last_state,omitempty"`
+}
+
+// vanishReason returns why a post from upstream counts as vanished, or "" if it doesn't.
+// known is false if we can't tell: anonymous requests get null file urls for posts on the global blacklist too,
+// which the next request with a login would restore. Those are neither recorded nor restored.
+func vanishReason(p *Post) (reason string, known bool) {
+	switch {
+	case p.Flags.Deleted:
+		return tombstoneDeleted, true
+	case p.File.URL == "" && p.File.MD5 != "":
+		return tombstoneFileHidden, p.Authenticated
+	}
+	return "", true
+}
+
+// serveVanishedPost answers a 404 from upstream for /posts/{id}.json. It records the tombstone if we know the post,
+// and answers from the archive if the user may see it. Returns false if the 404 should go to the client as it is.
+func serveVanishedPost(c *gin.Context, id int64) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	post, err := Database.TombstonePost(ctx, id, tombstoneNotFound)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		logging.Error("Error recording tombstone of post %v: %v", id, err)
+		return false
+	}
+	logging.Info("Post %v is gone upstream", id)
+
+	user := c.GetString(proxyUserKey)
+	if !canSeeHiddenFiles(user) {
+		return false
+	}
+
+	// saved before we kept upstream's json
+	if len(post.Raw) == 0 {
+		c.Header("X-E6-Cache", "tombstone")
+		rewritePostURLs(post, user)
+		c.JSON(http.StatusOK, PostResponse{Post: *post})
+		return true
+	}
+
+	// upstream's json as we last saw it, with the last known urls of the post
+	body, err := rewritePosts([]byte(`{"post":`+string(post.Raw)+`}`), user, func(path jsonrewrite.Path) (*Post, jsonrewrite.Path) {
+		if len(path) > 0 && path[0] == "post" {
+			return post, path[1:]
+		}
+		return nil, nil
+	})
+	if err != nil {
+		logging.Error("Error rewriting archived post %v: %v", id, err)
+		return false
+	}
+	c.Header("X-E6-Cache", "tombstone")
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+	return true
+}
+
+// vanishedPosts lists the posts that vanished upstream recently, newest first.
+// since is a duration (24h) or a timestamp, restored=true includes posts that came back.
+func vanishedPosts(c *gin.Context) {
+	since := time.Now().Add(-7 * 24 * time.Hour)
+	if value := c.Query("since"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+			since = t
+		} else {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid since, expected a duration or an RFC 3339 timestamp", "ok": false})
+			return
+		}
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = min(l, 1000)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+
+	tombstones, err := Database.Tombstones(ctx, since, c.Query("restored") == "true", limit)
+	if err != nil {
+		logging.Error("Error loading tombstones: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tombstones", "ok": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"since": since, "tombstones": tombstones})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testPostVersion returns the first post of posts.json with change applied to its json, decoded like it came from upstream.
+func testPostVersion(t *testing.T, changeSeq int, change func(post map[string]any)) *Post {
+	t.Helper()
+	_, posts := loadTestPosts(t)
+	var fields map[string]any
+	if err := json.Unmarshal(posts.Posts[0].Raw, &fields); err != nil {
+		t.Fatalf("Failed to decode the post: %v", err)
+	}
+	fields["change_seq"] = changeSeq
+	if change != nil {
+		change(fields)
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Failed to encode the post: %v", err)
+	}
+	var post Post
+	if err := json.Unmarshal(data, &post); err != nil {
+		t.Fatalf("Failed to decode the changed post: %v", err)
+	}
+	return &post
+}
+
+func deletePost(post map[string]any) {
+	post["flags"].(map[string]any)["deleted"] = true
+	hideFile(post)
+}
+
+// hideFile nulls the urls, like upstream does for deleted posts and for anonymous users.
+func hideFile(post map[string]any) {
+	for _, field := range []string{"file", "preview", "sample"} {
+		post[field].(map[string]any)["url"] = nil
+	}
+}
+
+func upsert(t *testing.T, d *sqlDB, posts ...*Post) {
+	t.Helper()
+	if err := d.UpsertPosts(context.Background(), posts); err != nil {
+		t.Fatalf("UpsertPosts failed: %v", err)
+	}
+}
+
+func loadTombstone(t *testing.T, d *sqlDB, id int) *Tombstone {
+	t.Helper()
+	var tombstone Tombstone
+	var restoredAt sql.NullTime
+	err := d.db.QueryRow(`SELECT reason, first_seen_at, restored_at FROM post_tombstones WHERE post_id = $1`, id).
+		Scan(&tombstone.Reason, &tombstone.FirstSeenAt, &restoredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Failed to load the tombstone of %d: %v", id, err)
+	}
+	if restoredAt.Valid {
+		tombstone.RestoredAt = &restoredAt.Time
+	}
+	return &tombstone
+}
+
+func TestTombstoneRecordRestore(t *testing.T) {
+	d := openTestDB(t)
+	ctx := context.Background()
+
+	post := testPostVersion(t, 1, nil)
+	upsert(t, d, post)
+	if tombstone := loadTombstone(t, d, post.ID); tombstone != nil {
+		t.Fatalf("Expected no tombstone for a post that is fine, got %+v", tombstone)
+	}
+
+	upsert(t, d, testPostVersion(t, 2, deletePost))
+	first := loadTombstone(t, d, post.ID)
+	if first == nil || first.Reason != tombstoneDeleted || first.RestoredAt != nil {
+		t.Fatalf("Expected a deleted tombstone, got %+v", first)
+	}
+
+	// the urls upstream doesn't send anymore are kept
+	stored, err := d.GetPost(ctx, int64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost failed: %v", err)
+	}
+	if stored.File.URL != post.File.URL || stored.Preview.URL != post.Preview.URL || !stored.Flags.Deleted {
+		t.Errorf("Expected the deleted post with its last known urls, got %+v", stored)
+	}
+
+	// seen again, it's the same tombstone
+	time.Sleep(10 * time.Millisecond)
+	upsert(t, d, testPostVersion(t, 2, deletePost))
+	if again := loadTombstone(t, d, post.ID); again == nil || !again.FirstSeenAt.Equal(first.FirstSeenAt) {
+		t.Errorf("Expected the tombstone to keep its first_seen_at %v, got %+v", first.FirstSeenAt, again)
+	}
+
+	// older versions don't restore it
+	upsert(t, d, testPostVersion(t, 1, nil))
+	if tombstone := loadTombstone(t, d, post.ID); tombstone == nil || tombstone.RestoredAt != nil {
+		t.Errorf("Expected an older version not to restore the post, got %+v", tombstone)
+	}
+
+	upsert(t, d, testPostVersion(t, 3, nil))
+	if tombstone := loadTombstone(t, d, post.ID); tombstone == nil || tombstone.RestoredAt == nil {
+		t.Fatalf("Expected the tombstone to be restored, got %+v", tombstone)
+	}
+
+	// deleted once more, it starts over
+	upsert(t, d, testPostVersion(t, 4, deletePost))
+	if tombstone := loadTombstone(t, d, post.ID); tombstone == nil || tombstone.RestoredAt != nil || !tombstone.FirstSeenAt.After(first.FirstSeenAt) {
+		t.Errorf("Expected a new tombstone after %v, got %+v", first.FirstSeenAt, tombstone)
+	}
+}
+
+// Anonymous users get null urls for posts on the global blacklist, that says nothing about the post.
+func TestTombstoneHiddenFile(t *testing.T) {
+	d := openTestDB(t)
+
+	post := testPostVersion(t, 1, nil)
+	upsert(t, d, post)
+
+	upsert(t, d, testPostVersion(t, 1, hideFile))
+	if tombstone := loadTombstone(t, d, post.ID); tombstone != nil {
+		t.Fatalf("Expected no tombstone from an anonymous request, got %+v", tombstone)
+	}
+
+	hidden := testPostVersion(t, 1, hideFile)
+	hidden.Authenticated = true
+	upsert(t, d, hidden)
+	first := loadTombstone(t, d, post.ID)
+	if first == nil || first.Reason != tombstoneFileHidden {
+		t.Fatalf("Expected a file_hidden tombstone, got %+v", first)
+	}
+
+	// an anonymous request doesn't restore it either
+	upsert(t, d, testPostVersion(t, 1, hideFile))
+	if tombstone := loadTombstone(t, d, post.ID); tombstone == nil || tombstone.RestoredAt != nil {
+		t.Errorf("Expected the tombstone to stay, got %+v", tombstone)
+	}
+
+	upsert(t, d, testPostVersion(t, 1, nil))
+	if tombstone := loadTombstone(t, d, post.ID); tombstone == nil || tombstone.RestoredAt == nil {
+		t.Errorf("Expected the tombstone to be restored, got %+v", tombstone)
+	}
+}
+
+func TestServeVanishedPost(t *testing.T) {
+	d := openTestDB(t)
+	setupLinks(t)
+	setHiddenFiles(t, hiddenFilesAll)
+
+	post := testPostVersion(t, 1, nil)
+	upsert(t, d, post)
+	upsert(t, d, testPostVersion(t, 2, deletePost))
+
+	serve := func(id int) (*httptest.ResponseRecorder, bool) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/posts/"+strconv.Itoa(id)+".json", nil)
+		return w, serveVanishedPost(c, int64(id))
+	}
+
+	if _, ok := serve(1); ok {
+		t.Errorf("Expected a post we never had to be left to upstream's 404")
+	}
+
+	w, ok := serve(post.ID)
+	if !ok || w.Code != http.StatusOK || w.Header().Get("X-E6-Cache") != "tombstone" {
+		t.Fatalf("Expected the archived post, got %v %d %v", ok, w.Code, w.Header())
+	}
+	var response struct {
+		Post map[string]any `json:"post"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode the response: %v", err)
+	}
+	// fields we don't have columns for are still there
+	if _, ok := response.Post["vote_score"]; !ok {
+		t.Errorf("Expected upstream's json with vote_score, got %v", response.Post)
+	}
+	if url, _ := response.Post["file"].(map[string]any)["url"].(string); !strings.HasPrefix(url, PROXY_URL+"/media/"+post.File.MD5) {
+		t.Errorf("Expected a link to the last known file url, got %q", url)
+	}
+	if tombstone := loadTombstone(t, d, post.ID); tombstone == nil || tombstone.Reason != tombstoneNotFound {
+		t.Errorf("Expected a not_found tombstone, got %+v", tombstone)
+	}
+
+	// without HIDDEN_FILES, the 404 goes to the client, and there are no links to the deleted post
+	hiddenFiles = hiddenFilesOff
+	if _, ok := serve(post.ID); ok {
+		t.Errorf("Expected no archived post with HIDDEN_FILES=off")
+	}
+	stored, err := d.GetPost(context.Background(), int64(post.ID))
+	if err != nil {
+		t.Fatalf("GetPost failed: %v", err)
+	}
+	if link := makeProxyLink(stored, variantOriginal, ""); link != "" {
+		t.Errorf("Expected no link to a deleted post, got %v", link)
+	}
+}
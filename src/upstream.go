@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Requests e6-cache makes on its own, not for a client: refreshes and archive runs.
+
+var upstreamAuth string // "username:api_key" to make them as, set with UPSTREAM_AUTH. Empty for anonymous
+
+// fetchUpstream asks E6_BASE for path and decodes the json answer into v. It returns the url, without credentials, for Archived.
+// Client errors (except 429) wrap errJobPermanent, asking again won't help.
+func fetchUpstream(ctx context.Context, path string, query url.Values, v any) (string, error) {
+	upstreamURL := baseURL + path
+	if len(query) > 0 {
+		upstreamURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return "", err
+	}
+	username, apiKey, _ := strings.Cut(upstreamAuth, ":")
+	if upstreamAuth != "" {
+		req.SetBasicAuth(username, apiKey)
+	}
+	setUseragent(username, req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return "", fmt.Errorf("%w: upstream answered %v for %v", errJobPermanent, resp.Status, path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream answered %v for %v", resp.Status, path)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return "", fmt.Errorf("decoding %v: %w", path, err)
+	}
+	return archiveSourceURL(upstreamURL), nil
+}
+
+// fetchPosts searches upstream, with the same parameters as /posts.json.
+func fetchPosts(ctx context.Context, query url.Values) ([]*Post, error) {
+	var page PostsResponse
+	sourceURL, err := fetchUpstream(ctx, "/posts.json", query, &page)
+	if err != nil {
+		return nil, err
+	}
+
+	fetchedAt := time.Now()
+	posts := make([]*Post, len(page.Posts))
+	for i := range page.Posts {
+		page.Posts[i].setFetched(fetchedAt, sourceURL)
+		page.Posts[i].Authenticated = upstreamAuth != ""
+		posts[i] = &page.Posts[i]
+	}
+	return posts, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bugmaschine/e6-cache/logging"
+	"context"
+	"expvar"
+	"time"
+)
+
+var (
+	writeBehind      = false // save posts in the background instead of before answering, set with WRITE_BEHIND
+	writeQueueSize   = 10000 // posts waiting to be saved, set with WRITE_QUEUE_SIZE
+	postWriteTimeout = 30 * time.Second
+
+	// started in main if writeBehind is enabled
+	postWrites *postWriter
+
+	// served on /admin/metrics
+	metrics = expvar.NewMap("e6cache")
+)
+
+const (
+	writeBatchSize  = 500                    // max posts per transaction
+	writeBatchDelay = 200 * time.Millisecond // how long to wait for more posts before writing a batch
+)
+
+// savePosts stores a page of posts, right away or through the write-behind queue.
+// The posts are copied, so the caller can rewrite their urls afterwards.
+func savePosts(posts []*Post) {
+	copies := make([]*Post, len(posts))
+	for i, p := range posts {
+		post := *p
+		copies[i] = &post
+	}
+
+	if postWrites != nil {
+		postWrites.enqueue(copies)
+		return
+	}
+	writePosts(copies)
+}
+
+// writePosts stores posts in one transaction. Failures only end up in the log and metrics, the client still gets its answer.
+func writePosts(posts []*Post) {
+	ctx, cancel := context.WithTimeout(context.Background(), postWriteTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := Database.UpsertPosts(ctx, posts)
+	metrics.Add("post_write_batches", 1)
+	metrics.Add("post_write_ms", time.Since(start).Milliseconds())
+
+	if err != nil {
+		logging.Error("Failed to save %d posts: %v", len(posts), err)
+		metrics.Add("post_write_errors", 1)
+		metrics.Add("posts_failed", int64(len(posts)))
+		return
+	}
+	metrics.Add("posts_written", int64(len(posts)))
+}
+
+// postWriter collects posts from many requests and writes them in batches.
+type postWriter struct {
+	queue chan *Post
+	done  chan struct{}
+}
+
+func startPostWriter(size int) *postWriter {
+	w := &postWriter{queue: make(chan *Post, size), done: make(chan struct{})}
+	metrics.Set("post_write_queue", expvar.Func(func() any { return len(w.queue) }))
+
+	go w.run()
+	return w
+}
+
+// enqueue adds posts to the queue. If it's full, the database can't keep up, so the request has to wait for the write instead.
+func (w *postWriter) enqueue(posts []*Post) {
+	for i, p := range posts {
+		select {
+		case w.queue <- p:
+		default:
+			metrics.Add("post_write_queue_full", 1)
+			writePosts(posts[i:])
+			return
+		}
+	}
+}
+
+func (w *postWriter) run() {
+	defer close(w.done)
+
+	for {
+		// wait for the first post of a batch
+		post, ok := <-w.queue
+		if !ok {
+			return
+		}
+		batch := []*Post{post}
+
+		// then take whatever else comes in shortly after
+		timer := time.NewTimer(writeBatchDelay)
+	collect:
+		for len(batch) < writeBatchSize {
+			select {
+			case post, ok := <-w.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, post)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		writePosts(batch)
+	}
+}
+
+// close writes what's still queued, or gives up once ctx is done.
+func (w *postWriter) close(ctx context.Context) error {
+	close(w.queue)
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		logging.Warn("Giving up on %d queued posts", len(w.queue))
+		return ctx.Err()
+	}
+}